@@ -0,0 +1,261 @@
+// Package client calls the director HTTP API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"git.reaxoft.loc/infomir/director/core"
+	"git.reaxoft.loc/infomir/director/hmacauth"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An error returned by the server which is not a director.DirectorError, e.g. a bad request
+// or an internal server error.
+type ServerError struct {
+	Status int
+	Code   string
+	Msg    string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("Server error: status = %d, code = '%s', msg = '%s'", e.Status, e.Code, e.Msg)
+}
+
+type Client struct {
+	base    string
+	hc      *http.Client
+	token   string
+	hmacId  string
+	hmacKey []byte
+}
+
+// Creates a client of the director at base, e.g. "http://director.cust.rxt:8080/director".
+// If hc is nil http.DefaultClient is used.
+func New(base string, hc *http.Client) *Client {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return &Client{base: strings.TrimSuffix(base, "/"), hc: hc}
+}
+
+// Authenticates requests by the bearer token, either a static token or a JWT.
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+// Authenticates requests by signing them with the HMAC key of the principal.
+func (c *Client) SetHmacKey(principal string, key []byte) {
+	c.hmacId, c.hmacKey = principal, key
+}
+
+// Registers the service instance of the type. Returns the lease if the instance got one, otherwise nil.
+func (c *Client) Register(ctx context.Context, srvtype string, srv *director.DnsService) (*director.Lease, error) {
+	return c.RegisterIf(ctx, srvtype, srv, nil)
+}
+
+// Registers the service instance if the condition is met, otherwise returns a director.DirectorError
+// with director.ErrDirConflict code. The tag for cond.IfMatch is returned by FindInstancesTag.
+func (c *Client) RegisterIf(ctx context.Context, srvtype string, srv *director.DnsService, cond *director.RegCond) (*director.Lease, error) {
+	h := make(http.Header)
+	if cond != nil && cond.IfAbsent {
+		h.Set("If-None-Match", "*")
+	}
+	if cond != nil && cond.IfMatch != "" {
+		h.Set("If-Match", cond.IfMatch)
+	}
+	var lease director.Lease
+	status, _, e := c.doWithHeader(ctx, "PUT", "/services/"+url.PathEscape(srvtype), nil, h, srv, &lease)
+	if e != nil {
+		return nil, e
+	}
+	if status == http.StatusCreated && lease.Id != "" {
+		return &lease, nil
+	}
+	return nil, nil
+}
+
+// Registers all the service instances at once, either all or none of them are registered.
+// Returns leases in the order of the registrations, nil for instances without a lease.
+func (c *Client) RegisterBatch(ctx context.Context, batch []*director.Registration) ([]*director.Lease, error) {
+	var leases []*director.Lease
+	if _, e := c.do(ctx, "POST", "/services/batch", nil, batch, &leases); e != nil {
+		return nil, e
+	}
+	return leases, nil
+}
+
+// Renews the lease got on registration.
+func (c *Client) RenewLease(ctx context.Context, id string) (*director.Lease, error) {
+	var lease director.Lease
+	if _, e := c.do(ctx, "PUT", "/leases/"+url.PathEscape(id)+"/heartbeat", nil, nil, &lease); e != nil {
+		return nil, e
+	}
+	return &lease, nil
+}
+
+// Returns the service types of the domain.
+func (c *Client) FindTypes(ctx context.Context) ([]string, error) {
+	var types []string
+	if _, e := c.do(ctx, "GET", "/services/types", nil, nil, &types); e != nil {
+		return nil, e
+	}
+	return types, nil
+}
+
+// Returns names of services of the type.
+func (c *Client) FindNames(ctx context.Context, srvtype string) ([]string, error) {
+	var names []string
+	if _, e := c.do(ctx, "GET", "/services/types/"+url.PathEscape(srvtype), nil, nil, &names); e != nil {
+		return nil, e
+	}
+	return names, nil
+}
+
+// Returns instances of the service.
+func (c *Client) FindInstances(ctx context.Context, srvname string) ([]*director.DnsService, error) {
+	srvs, _, e := c.FindInstancesTag(ctx, srvname)
+	return srvs, e
+}
+
+// Returns instances of the service and the tag of the service params for RegisterIf.
+func (c *Client) FindInstancesTag(ctx context.Context, srvname string) ([]*director.DnsService, string, error) {
+	var srvs []*director.DnsService
+	_, h, e := c.doWithHeader(ctx, "GET", "/services/instances/"+url.PathEscape(srvname), nil, nil, nil, &srvs)
+	if e != nil {
+		return nil, "", e
+	}
+	return srvs, h.Get("ETag"), nil
+}
+
+// Changes the instance of the service at server:port in place. Returns the changed instance.
+func (c *Client) UpdateInstance(ctx context.Context, srvname, server string, port uint16, patch *director.DnsServicePatch) (*director.DnsService, error) {
+	var srv director.DnsService
+	q := url.Values{"server": {server}, "port": {strconv.FormatUint(uint64(port), 10)}}
+	if _, e := c.do(ctx, "PATCH", "/services/instances/"+url.PathEscape(srvname), q, patch, &srv); e != nil {
+		return nil, e
+	}
+	return &srv, nil
+}
+
+// Removes the service with all its instances from the type.
+func (c *Client) RmService(ctx context.Context, srvtype, srvname string) error {
+	q := url.Values{"name": {srvname}}
+	_, e := c.do(ctx, "DELETE", "/services/types/"+url.PathEscape(srvtype), q, nil, nil)
+	return e
+}
+
+// Removes the instance of the service at server:port.
+func (c *Client) RmInstance(ctx context.Context, srvname, server string, port uint16) error {
+	q := url.Values{"server": {server}, "port": {strconv.FormatUint(uint64(port), 10)}}
+	_, e := c.do(ctx, "DELETE", "/services/instances/"+url.PathEscape(srvname), q, nil, nil)
+	return e
+}
+
+type watchResult struct {
+	Index  uint64            `json:"index"`
+	Events []*director.Event `json:"events"`
+}
+
+// Waits for names attached to or detached from the type after index. Returns the events and
+// the index to wait from next time, index 0 returns the current index at once.
+func (c *Client) WatchType(ctx context.Context, srvtype string, index uint64) ([]*director.Event, uint64, error) {
+	return c.watch(ctx, "/watch/types/"+url.PathEscape(srvtype), index)
+}
+
+// Waits for instances added to or removed from the service after index.
+func (c *Client) WatchName(ctx context.Context, srvname string, index uint64) ([]*director.Event, uint64, error) {
+	return c.watch(ctx, "/watch/instances/"+url.PathEscape(srvname), index)
+}
+
+func (c *Client) watch(ctx context.Context, path string, index uint64) ([]*director.Event, uint64, error) {
+	var res watchResult
+	q := url.Values{"index": {strconv.FormatUint(index, 10)}}
+	if _, e := c.do(ctx, "GET", path, q, nil, &res); e != nil {
+		return nil, index, e
+	}
+	return res.Events, res.Index, nil
+}
+
+// Sends the request with in as JSON body and decodes the JSON response into out.
+func (c *Client) do(ctx context.Context, method, path string, q url.Values, in, out interface{}) (int, error) {
+	status, _, e := c.doWithHeader(ctx, method, path, q, nil, in, out)
+	return status, e
+}
+
+// Like do, but also sends the headers h and returns the response headers.
+func (c *Client) doWithHeader(ctx context.Context, method, path string, q url.Values, h http.Header, in, out interface{}) (int, http.Header, error) {
+	u := c.base + path
+	if len(q) != 0 {
+		u += "?" + q.Encode()
+	}
+	var body io.Reader
+	var inb []byte
+	if in != nil {
+		b, e := json.Marshal(in)
+		if e != nil {
+			return 0, nil, e
+		}
+		body, inb = bytes.NewReader(b), b
+	}
+	req, e := http.NewRequest(method, u, body)
+	if e != nil {
+		return 0, nil, e
+	}
+	req = req.WithContext(ctx)
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.hmacKey != nil {
+		date := time.Now().UTC().Format(http.TimeFormat)
+		req.Header.Set("Date", date)
+		req.Header.Set("Authorization", hmacauth.Authorization(c.hmacId, c.hmacKey, method, req.URL.RequestURI(), date, inb))
+	}
+
+	resp, e := c.hc.Do(req)
+	if e != nil {
+		return 0, nil, e
+	}
+	defer resp.Body.Close()
+	b, e := ioutil.ReadAll(resp.Body)
+	if e != nil {
+		return resp.StatusCode, resp.Header, e
+	}
+	if resp.StatusCode >= 400 {
+		return resp.StatusCode, resp.Header, decodeError(resp.StatusCode, b)
+	}
+	if out != nil && len(b) != 0 {
+		if e := json.Unmarshal(b, out); e != nil {
+			return resp.StatusCode, resp.Header, e
+		}
+	}
+	return resp.StatusCode, resp.Header, nil
+}
+
+// Codes of director errors start with "director_", other codes are server errors.
+func decodeError(status int, b []byte) error {
+	var body struct {
+		Code string `json:"code"`
+		Msg  string `json:"msg"`
+	}
+	if e := json.Unmarshal(b, &body); e != nil || body.Code == "" {
+		return &ServerError{Status: status, Code: http.StatusText(status), Msg: strings.TrimSpace(string(b))}
+	}
+	if strings.HasPrefix(body.Code, "director_") {
+		return &director.DirectorError{Code: body.Code, Msg: body.Msg}
+	}
+	return &ServerError{Status: status, Code: body.Code, Msg: body.Msg}
+}
@@ -0,0 +1,203 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"git.reaxoft.loc/infomir/director/core"
+	"git.reaxoft.loc/infomir/director/hmacauth"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Serves the part of the director API the client and the registrar use, instances are kept in memory.
+type fakeDirector struct {
+	lock      sync.Mutex
+	hmacKeys  map[string][]byte
+	reject    map[string]bool
+	instances map[string]*director.DnsService
+	leases    map[string]string
+	leaseTtl  uint32
+	nextLease int
+	renewals  int
+}
+
+func newFakeDirector() *fakeDirector {
+	return &fakeDirector{reject: make(map[string]bool), instances: make(map[string]*director.DnsService), leases: make(map[string]string), leaseTtl: 30}
+}
+
+func fakeKey(name, server string, port uint16) string {
+	return name + "@" + server + ":" + strconv.Itoa(int(port))
+}
+
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"code": code, "msg": msg})
+}
+
+func (f *fakeDirector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	if f.hmacKeys != nil {
+		auth := r.Header.Get("Authorization")
+		principal := strings.SplitN(strings.TrimPrefix(auth, hmacauth.Scheme+" "), ":", 2)[0]
+		key := f.hmacKeys[principal]
+		if key == nil || auth != hmacauth.Authorization(principal, key, r.Method, r.URL.RequestURI(), r.Header.Get("Date"), body) {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "signature mismatch")
+			return
+		}
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/director")
+	q := r.URL.Query()
+	switch {
+	case r.Method == "PUT" && strings.HasPrefix(path, "/leases/"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/leases/"), "/heartbeat")
+		if _, ok := f.leases[id]; !ok {
+			writeError(w, http.StatusNotFound, director.ErrDirLeaseNotFound, "lease not found")
+			return
+		}
+		f.renewals++
+		json.NewEncoder(w).Encode(&director.Lease{Id: id, Ttl: f.leaseTtl})
+	case r.Method == "PUT" && strings.HasPrefix(path, "/services/"):
+		var srv director.DnsService
+		if e := json.Unmarshal(body, &srv); e != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", e.Error())
+			return
+		}
+		if f.reject[srv.Name] {
+			writeError(w, http.StatusBadRequest, director.ErrDirWrongSrvName, "rejected")
+			return
+		}
+		key := fakeKey(srv.Name, srv.Server, srv.Port)
+		f.instances[key] = &srv
+		w.WriteHeader(http.StatusCreated)
+		if srv.LeaseTtl != 0 {
+			f.nextLease++
+			id := "lease" + strconv.Itoa(f.nextLease)
+			f.leases[id] = key
+			json.NewEncoder(w).Encode(&director.Lease{Id: id, Ttl: f.leaseTtl})
+		}
+	case r.Method == "GET" && strings.HasPrefix(path, "/services/instances/"):
+		name := strings.TrimPrefix(path, "/services/instances/")
+		srvs := []*director.DnsService{}
+		for _, srv := range f.instances {
+			if srv.Name == name {
+				srvs = append(srvs, srv)
+			}
+		}
+		json.NewEncoder(w).Encode(srvs)
+	case r.Method == "DELETE" && strings.HasPrefix(path, "/services/instances/"):
+		port, _ := strconv.Atoi(q.Get("port"))
+		key := fakeKey(strings.TrimPrefix(path, "/services/instances/"), q.Get("server"), uint16(port))
+		if _, ok := f.instances[key]; !ok {
+			writeError(w, http.StatusNotFound, director.ErrDirInstNotFound, "instance not found")
+			return
+		}
+		delete(f.instances, key)
+		for id, k := range f.leases {
+			if k == key {
+				delete(f.leases, id)
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("no such route"))
+	}
+}
+
+// Forgets the instances and their leases, as a director restarted without a store does.
+func (f *fakeDirector) forget() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.instances = make(map[string]*director.DnsService)
+	f.leases = make(map[string]string)
+}
+
+// Returns the keys of the registered instances.
+func (f *fakeDirector) registered() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var keys []string
+	for key := range f.instances {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestClientRegisterFindRm(t *testing.T) {
+	const srvtype, name = "_bo._rest_http._tcp.cust.rxt.", "bo1._bo._rest_http._tcp.cust.rxt."
+	f := newFakeDirector()
+	f.hmacKeys = map[string][]byte{"billing": []byte("secret")}
+	s := httptest.NewServer(f)
+	defer s.Close()
+	c := New(s.URL+"/director/", nil)
+	c.SetHmacKey("billing", []byte("secret"))
+	ctx := context.Background()
+
+	lease, err := c.Register(ctx, srvtype, &director.DnsService{Name: name, Server: "h1.cust.rxt.", Port: 80, LeaseTtl: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease == nil || lease.Id == "" || lease.Ttl != 30 {
+		t.Errorf("lease %+v", lease)
+	}
+	if lease, err := c.Register(ctx, srvtype, &director.DnsService{Name: name, Server: "h2.cust.rxt.", Port: 80}); err != nil || lease != nil {
+		t.Errorf("registration without a lease: %+v, %v", lease, err)
+	}
+
+	srvs, err := c.FindInstances(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := make(map[string]bool)
+	for _, srv := range srvs {
+		servers[srv.Server] = true
+	}
+	if !reflect.DeepEqual(servers, map[string]bool{"h1.cust.rxt.": true, "h2.cust.rxt.": true}) {
+		t.Errorf("instances %v", servers)
+	}
+
+	if err := c.RmInstance(ctx, name, "h1.cust.rxt.", 80); err != nil {
+		t.Fatal(err)
+	}
+	err = c.RmInstance(ctx, name, "h1.cust.rxt.", 80)
+	if de, ok := err.(*director.DirectorError); !ok || de.Code != director.ErrDirInstNotFound {
+		t.Errorf("removal of a removed instance: want %s, got %v", director.ErrDirInstNotFound, err)
+	}
+
+	c.SetHmacKey("billing", []byte("another secret"))
+	_, err = c.FindInstances(ctx, name)
+	if se, ok := err.(*ServerError); !ok || se.Status != http.StatusUnauthorized || se.Code != "unauthorized" {
+		t.Errorf("request signed by another key: want unauthorized, got %v", err)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		err    error
+	}{
+		{"director error", 404, `{"code": "director_instance_not_found", "msg": "not found"}`,
+			&director.DirectorError{Code: director.ErrDirInstNotFound, Msg: "not found"}},
+		{"server error", 401, `{"code": "unauthorized", "msg": "unknown token"}`,
+			&ServerError{Status: 401, Code: "unauthorized", Msg: "unknown token"}},
+		{"not JSON", 502, "Bad Gateway\n", &ServerError{Status: 502, Code: "Bad Gateway", Msg: "Bad Gateway"}},
+		{"no code", 500, `{"msg": "oops"}`, &ServerError{Status: 500, Code: "Internal Server Error", Msg: `{"msg": "oops"}`}},
+		{"code with the prefix inside", 400, `{"code": "not_director_error", "msg": "bad"}`,
+			&ServerError{Status: 400, Code: "not_director_error", Msg: "bad"}},
+	}
+	for _, tt := range tests {
+		if err := decodeError(tt.status, []byte(tt.body)); !reflect.DeepEqual(err, tt.err) {
+			t.Errorf("%s: %#v, want %#v", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package client
+
+import (
+	"context"
+	"git.reaxoft.loc/infomir/director/core"
+	"sync"
+	"time"
+)
+
+// Lease duration requested for services which do not request one, so the instances are removed
+// by the director if the process dies without deregistering them.
+const DefaultLeaseTtl = 30
+
+const (
+	minRetryInterval = time.Second
+	maxRetryInterval = 30 * time.Second
+	// how long Start may take to remove the services registered before a failed one
+	removeTimeout = 10 * time.Second
+)
+
+// A service instance of the type to keep registered.
+type Service struct {
+	Type string
+	director.DnsService
+}
+
+// Receives the failures the Registrar recovers from by retrying, and those of Stop.
+type Logger interface {
+	Warn(format string, args ...interface{})
+	Error(format string, args ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Warn(format string, args ...interface{})  {}
+func (nopLogger) Error(format string, args ...interface{}) {}
+
+type registered struct {
+	srv   *Service
+	lease *director.Lease
+}
+
+// Keeps services registered in the director: registers them with retries, renews their leases
+// and removes them on Stop.
+//
+//	r := client.NewRegistrar(client.New("http://director.cust.rxt:8080/director", nil), services)
+//	if e := r.Start(ctx); e != nil {
+//		...
+//	}
+//	<-stop
+//	r.Stop(context.Background())
+type Registrar struct {
+	c      *Client
+	regs   []*registered
+	logger Logger
+	lock   sync.Mutex
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func NewRegistrar(c *Client, srvs []*Service) *Registrar {
+	regs := make([]*registered, len(srvs))
+	for i, srv := range srvs {
+		s := *srv
+		if s.LeaseTtl == 0 {
+			s.LeaseTtl = DefaultLeaseTtl
+		}
+		regs[i] = &registered{srv: &s}
+	}
+	return &Registrar{c: c, regs: regs, logger: nopLogger{}}
+}
+
+// Logs the failures to l, nothing is logged by default. Must be called before Start.
+func (r *Registrar) SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	r.logger = l
+}
+
+// Registers all services retrying failed registrations until ctx is done, then keeps the
+// leases alive until Stop. If a service can not be registered, those registered before it are
+// removed, so either all services are registered or none.
+func (r *Registrar) Start(ctx context.Context) error {
+	for i, reg := range r.regs {
+		if e := r.register(ctx, reg); e != nil {
+			// ctx may be done already, the removal gets its own time
+			rctx, cancel := context.WithTimeout(context.Background(), removeTimeout)
+			r.remove(rctx, r.regs[:i])
+			cancel()
+			return e
+		}
+	}
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.keepAlive()
+	return nil
+}
+
+// Stops renewing the leases and removes the instances of all services.
+func (r *Registrar) Stop(ctx context.Context) error {
+	if r.stop != nil {
+		close(r.stop)
+		<-r.done
+		r.stop = nil
+	}
+	return r.remove(ctx, r.regs)
+}
+
+// Removes the instances of the services, returns the last failure.
+func (r *Registrar) remove(ctx context.Context, regs []*registered) error {
+	var lastErr error
+	for _, reg := range regs {
+		if e := r.c.RmInstance(ctx, reg.srv.Name, reg.srv.Server, reg.srv.Port); e != nil {
+			r.logger.Error("Removing '%s' at '%s:%d' failed: %s", reg.srv.Name, reg.srv.Server, reg.srv.Port, e.Error())
+			lastErr = e
+		}
+		r.lock.Lock()
+		reg.lease = nil
+		r.lock.Unlock()
+	}
+	return lastErr
+}
+
+func (r *Registrar) register(ctx context.Context, reg *registered) error {
+	interval := minRetryInterval
+	for {
+		lease, e := r.c.Register(ctx, reg.srv.Type, &reg.srv.DnsService)
+		if e == nil {
+			r.lock.Lock()
+			reg.lease = lease
+			r.lock.Unlock()
+			return nil
+		}
+		if _, ok := e.(*director.DirectorError); ok {
+			// the service is invalid, retrying does not help
+			return e
+		}
+		r.logger.Warn("Registering '%s' failed, retrying in %s: %s", reg.srv.Name, interval, e.Error())
+		select {
+		case <-ctx.Done():
+			return e
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+	}
+}
+
+// Renews the leases three times per the shortest lease duration. Instances whose leases are
+// lost, e.g. after the director has been restarted without a store, are registered again.
+func (r *Registrar) keepAlive() {
+	defer close(r.done)
+	var ttl uint32
+	for _, reg := range r.regs {
+		if reg.lease != nil && (ttl == 0 || reg.lease.Ttl < ttl) {
+			ttl = reg.lease.Ttl
+		}
+	}
+	if ttl == 0 {
+		<-r.stop
+		return
+	}
+
+	t := time.NewTicker(time.Duration(ttl) * time.Second / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-t.C:
+			for _, reg := range r.regs {
+				r.renew(reg)
+			}
+		}
+	}
+}
+
+func (r *Registrar) renew(reg *registered) {
+	r.lock.Lock()
+	lease := reg.lease
+	r.lock.Unlock()
+	if lease == nil {
+		return
+	}
+
+	// Stop resets r.stop once keepAlive is done, the goroutine may outlive renew
+	stop := r.stop
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	_, e := r.c.RenewLease(ctx, lease.Id)
+	if e == nil {
+		return
+	}
+	if de, ok := e.(*director.DirectorError); ok && de.Code == director.ErrDirLeaseNotFound {
+		r.logger.Warn("Lease of '%s' at '%s:%d' is lost, registering it again", reg.srv.Name, reg.srv.Server, reg.srv.Port)
+		if e := r.register(ctx, reg); e != nil {
+			r.logger.Error("Registering '%s' again failed: %s", reg.srv.Name, e.Error())
+		}
+		return
+	}
+	r.logger.Warn("Renewing lease of '%s' failed: %s", reg.srv.Name, e.Error())
+}
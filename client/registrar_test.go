@@ -0,0 +1,117 @@
+package client
+
+import (
+	"context"
+	"git.reaxoft.loc/infomir/director/core"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+const testSrvType = "_bo._rest_http._tcp.cust.rxt."
+
+func testServices(names ...string) []*Service {
+	var srvs []*Service
+	for _, name := range names {
+		srvs = append(srvs, &Service{Type: testSrvType, DnsService: director.DnsService{Name: name, Server: "h1.cust.rxt.", Port: 80}})
+	}
+	return srvs
+}
+
+// Fails the test unless cond is met within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestRegistrarStartStop(t *testing.T) {
+	f := newFakeDirector()
+	s := httptest.NewServer(f)
+	defer s.Close()
+	r := NewRegistrar(New(s.URL+"/director", nil), testServices("bo1."+testSrvType, "bo2."+testSrvType))
+
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	keys := f.registered()
+	sort.Strings(keys)
+	want := []string{fakeKey("bo1."+testSrvType, "h1.cust.rxt.", 80), fakeKey("bo2."+testSrvType, "h1.cust.rxt.", 80)}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("registered %v, want %v", keys, want)
+	}
+	for _, reg := range r.regs {
+		if reg.lease == nil {
+			t.Errorf("'%s' got no lease, want the default one", reg.srv.Name)
+		}
+	}
+
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if keys := f.registered(); len(keys) != 0 {
+		t.Errorf("registered after Stop: %v", keys)
+	}
+}
+
+func TestRegistrarStartRemovesRegisteredOnFailure(t *testing.T) {
+	f := newFakeDirector()
+	f.reject["bo3."+testSrvType] = true
+	s := httptest.NewServer(f)
+	defer s.Close()
+	r := NewRegistrar(New(s.URL+"/director", nil), testServices("bo1."+testSrvType, "bo2."+testSrvType, "bo3."+testSrvType))
+
+	err := r.Start(context.Background())
+	if de, ok := err.(*director.DirectorError); !ok || de.Code != director.ErrDirWrongSrvName {
+		t.Fatalf("want %s, got %v", director.ErrDirWrongSrvName, err)
+	}
+	if keys := f.registered(); len(keys) != 0 {
+		t.Errorf("registered after the failed Start: %v", keys)
+	}
+}
+
+func TestRegistrarRenewsLeases(t *testing.T) {
+	f := newFakeDirector()
+	f.leaseTtl = 1
+	s := httptest.NewServer(f)
+	defer s.Close()
+	r := NewRegistrar(New(s.URL+"/director", nil), testServices("bo1."+testSrvType))
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop(context.Background())
+
+	waitFor(t, "lease renewals", func() bool {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		return f.renewals >= 2
+	})
+}
+
+func TestRegistrarRegistersForgottenInstances(t *testing.T) {
+	f := newFakeDirector()
+	f.leaseTtl = 1
+	s := httptest.NewServer(f)
+	defer s.Close()
+	r := NewRegistrar(New(s.URL+"/director", nil), testServices("bo1."+testSrvType))
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop(context.Background())
+
+	f.forget()
+	waitFor(t, "the registration again", func() bool { return len(f.registered()) == 1 })
+	r.lock.Lock()
+	lease := r.regs[0].lease
+	r.lock.Unlock()
+	f.lock.Lock()
+	_, known := f.leases[lease.Id]
+	f.lock.Unlock()
+	if !known {
+		t.Errorf("the registrar holds lease '%s' the director does not know", lease.Id)
+	}
+}
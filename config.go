@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Prefix of the environment variables overriding options, e.g. DIRECTOR_DNS_S for --dns-s.
+const envPrefix = "DIRECTOR_"
+
+// Long names of the short options. Options are named by their long names, without dashes,
+// in the config file and in environment variables, and "--<long name>" is accepted as well.
+var longNames = map[string]string{"-a": "addr", "-p": "port", "-h": "hostname", "-r": "root", "-d": "domain"}
+
+// Returns the name of the option in the config file, e.g. "dns-s" for --dns-s and "domain" for -d.
+func optKey(opt string) string {
+	if k, ok := longNames[opt]; ok {
+		return k
+	}
+	return strings.TrimPrefix(opt, "--")
+}
+
+// Returns the environment variable of the option, e.g. DIRECTOR_DNS_S for --dns-s.
+func optEnv(opt string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(optKey(opt), "-", "_", -1))
+}
+
+// Returns the option named on the command line, resolving the long names of the short options.
+func optName(arg string, opts map[string]OptsDesc) (string, bool) {
+	if _, ok := opts[arg]; ok {
+		return arg, true
+	}
+	for opt, k := range longNames {
+		if arg == "--"+k {
+			return opt, true
+		}
+	}
+	return "", false
+}
+
+// Splits the value of an option from the config file or an environment variable into its params.
+func optParams(desc OptsDesc, v string) []string {
+	if desc.prmsCnt == 1 {
+		return []string{v}
+	}
+	return strings.Fields(v)
+}
+
+// Reads option values from the YAML config file, e.g.:
+//
+//	domain: cust.rxt
+//	dns-s: 172.25.0.160:53
+//	dns-tsig: /etc/director/cust.rxt.tsig
+//	lease-ttl: 30
+//	trusted-proxies: [10.0.0.0/8, 127.0.0.1]
+//
+// Lists are joined by commas. Returns the values by option, and an error for every bad entry.
+func loadConfig(path string, opts map[string]OptsDesc) (map[string][]string, []error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, []error{&OptsError{"--config", err.Error()}}
+	}
+	var entries map[string]interface{}
+	if err := yaml.Unmarshal(b, &entries); err != nil {
+		return nil, []error{&OptsError{"--config", fmt.Sprintf("bad YAML in '%s': %s", path, err.Error())}}
+	}
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	byKey := make(map[string]string, len(opts))
+	for opt := range opts {
+		byKey[optKey(opt)] = opt
+	}
+	values := make(map[string][]string)
+	var errs []error
+	for _, k := range keys {
+		opt, ok := byKey[k]
+		if !ok {
+			errs = append(errs, fmt.Errorf("Config '%s': unknown option '%s'", path, k))
+			continue
+		}
+		switch v := entries[k].(type) {
+		case nil:
+			errs = append(errs, fmt.Errorf("Config '%s': option '%s' has no value", path, k))
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[opt] = optParams(opts[opt], strings.Join(items, ","))
+		case map[interface{}]interface{}:
+			errs = append(errs, fmt.Errorf("Config '%s': option '%s' must be a value or a list", path, k))
+		default:
+			values[opt] = optParams(opts[opt], fmt.Sprint(v))
+		}
+	}
+	return values, errs
+}
+
+// Merges option values of the config file, the environment and the command line, given in this
+// order, the later ones override the former ones.
+func mergeValues(srcs ...map[string][]string) map[string][]string {
+	values := make(map[string][]string)
+	for _, src := range srcs {
+		for opt, p := range src {
+			values[opt] = p
+		}
+	}
+	return values
+}
+
+// Returns option values given by DIRECTOR_* environment variables.
+func envValues(opts map[string]OptsDesc) map[string][]string {
+	values := make(map[string][]string)
+	for opt, desc := range opts {
+		if v, ok := os.LookupEnv(optEnv(opt)); ok {
+			values[opt] = optParams(desc, v)
+		}
+	}
+	return values
+}
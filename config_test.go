@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testOpts() map[string]OptsDesc {
+	desc := OptsDesc{1, func(p []string) error { return nil }, dummyDefHandler}
+	return map[string]OptsDesc{"-d": desc, "--dns-s": desc, "--lease-ttl": desc, "--trusted-proxies": desc,
+		"--pair": {2, desc.handler, dummyDefHandler}}
+}
+
+func writeConfig(t *testing.T, yaml string) (string, func()) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "director.yaml")
+	if err := ioutil.WriteFile(path, []byte(yaml), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name, yaml string
+		values     map[string][]string
+		errs       []string
+	}{
+		{"scalars", "domain: cust.rxt\ndns-s: 172.25.0.160:53\nlease-ttl: 30\n",
+			map[string][]string{"-d": {"cust.rxt"}, "--dns-s": {"172.25.0.160:53"}, "--lease-ttl": {"30"}}, nil},
+		{"list is joined by commas", "trusted-proxies: [10.0.0.0/8, 127.0.0.1]\n",
+			map[string][]string{"--trusted-proxies": {"10.0.0.0/8,127.0.0.1"}}, nil},
+		{"params are split by spaces", "pair: a b\n",
+			map[string][]string{"--pair": {"a", "b"}}, nil},
+		{"map is rejected", "dns-s:\n  host: 172.25.0.160\n",
+			map[string][]string{}, []string{"option 'dns-s' must be a value or a list"}},
+		{"empty value is rejected", "dns-s:\n",
+			map[string][]string{}, []string{"option 'dns-s' has no value"}},
+		{"unknown option", "dns-server: 172.25.0.160:53\ndomain: cust.rxt\n",
+			map[string][]string{"-d": {"cust.rxt"}}, []string{"unknown option 'dns-server'"}},
+	}
+	for _, tt := range tests {
+		path, cleanup := writeConfig(t, tt.yaml)
+		values, errs := loadConfig(path, testOpts())
+		cleanup()
+		if !reflect.DeepEqual(values, tt.values) {
+			t.Errorf("%s: values %v, want %v", tt.name, values, tt.values)
+		}
+		if len(errs) != len(tt.errs) {
+			t.Errorf("%s: errors %v, want %v", tt.name, errs, tt.errs)
+			continue
+		}
+		for i, err := range errs {
+			if !strings.Contains(err.Error(), tt.errs[i]) {
+				t.Errorf("%s: error '%s', want '%s'", tt.name, err, tt.errs[i])
+			}
+		}
+	}
+}
+
+func TestOptionPrecedence(t *testing.T) {
+	path, cleanup := writeConfig(t, "domain: file.rxt\ndns-s: 10.0.0.1:53\nlease-ttl: 30\n")
+	defer cleanup()
+	config, errs := loadConfig(path, testOpts())
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	for _, env := range []string{"DIRECTOR_DOMAIN", "DIRECTOR_DNS_S"} {
+		defer os.Unsetenv(env)
+	}
+	os.Setenv("DIRECTOR_DOMAIN", "env.rxt")
+	os.Setenv("DIRECTOR_DNS_S", "10.0.0.2:53")
+	cli := map[string][]string{"-d": {"cli.rxt"}}
+
+	values := mergeValues(config, envValues(testOpts()), cli)
+	want := map[string][]string{
+		"-d":          {"cli.rxt"},     // the command line overrides the environment
+		"--dns-s":     {"10.0.0.2:53"}, // the environment overrides the config file
+		"--lease-ttl": {"30"},          // the config file alone
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("values %v, want %v", values, want)
+	}
+}
+
+func TestTlsCheckedOnlyWithoutOptionErrors(t *testing.T) {
+	tests := []struct {
+		errs []error
+		has  bool
+	}{
+		{nil, false},
+		{[]error{&OptsError{"--dns-s", "is not found"}}, false},
+		{[]error{&OptsError{"--tls-key", "is not found"}}, true},
+		{[]error{&OptsError{"--dns-s", "is not found"}, &OptsError{"--tls-cert", "is not found"}}, true},
+	}
+	for i, tt := range tests {
+		if has := hasOptsError(tt.errs, "--tls-cert", "--tls-key"); has != tt.has {
+			t.Errorf("%d: %v, want %v", i, has, tt.has)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package director
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+const ErrDirWrongAddress = "director_wrong_address"
+
+// Builds A and AAAA records of the server. Returns the records and the addresses in canonical form.
+func addressRRs(server string, ttl uint32, addrs []string) ([]dns.RR, []string, error) {
+	var rrs []dns.RR
+	var canon []string
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, nil, NewDirectorError(ErrDirWrongAddress, "Address '%s' is not an IP address", a)
+		}
+		rrs = append(rrs, addressRR(server, ip, ttl))
+		canon = append(canon, ip.String())
+	}
+	return rrs, canon, nil
+}
+
+func addressRR(server string, ip net.IP, ttl uint32) dns.RR {
+	if ip4 := ip.To4(); ip4 != nil {
+		a := new(dns.A)
+		a.Hdr = dns.RR_Header{server, dns.TypeA, dns.ClassINET, ttl, 0}
+		a.A = ip4
+		return a
+	}
+	aaaa := new(dns.AAAA)
+	aaaa.Hdr = dns.RR_Header{server, dns.TypeAAAA, dns.ClassINET, ttl, 0}
+	aaaa.AAAA = ip
+	return aaaa
+}
+
+// Returns address records of the removed registrations which no other registration of the same
+// server uses, so the addresses are counted by the registrations referring to them. The added
+// registrations are taken as stored already. Withdrawn registrations are not in DNS, they get their
+// addresses back when they are reinstated.
+func (d *Director) unusedAddrs(removed []*Registration, added []*Registration) []dns.RR {
+	gone := make(map[string]bool, len(removed))
+	for _, reg := range removed {
+		gone[reg.key()] = true
+	}
+	used := make(map[string]bool)
+	use := func(reg *Registration) {
+		for _, a := range reg.Addresses {
+			used[strings.ToLower(reg.Server)+"|"+a] = true
+		}
+	}
+	for _, reg := range d.store.all() {
+		if !gone[reg.key()] && !d.health.isWithdrawn(reg.Name, reg.Server, reg.Port) {
+			use(reg)
+		}
+	}
+	for _, reg := range added {
+		use(reg)
+	}
+
+	var rrs []dns.RR
+	for _, reg := range removed {
+		for _, a := range reg.Addresses {
+			key := strings.ToLower(reg.Server) + "|" + a
+			if !used[key] {
+				used[key] = true
+				rrs = append(rrs, addressRR(reg.Server, net.ParseIP(a), 0))
+			}
+		}
+	}
+	return rrs
+}
+
+// Returns the host name under the domain for the address: "ip-10-0-0-1" for IPv4, and for IPv6
+// "ip6-" followed by all eight groups, e.g. "ip6-fd00-0000-0000-0000-0000-0000-0000-0001".
+func (d *Director) AddressHost(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "ip-" + strings.Replace(ip4.String(), ".", "-", -1) + d.domain
+	}
+	groups := make([]string, 8)
+	for i := range groups {
+		groups[i] = fmt.Sprintf("%02x%02x", ip[2*i], ip[2*i+1])
+	}
+	return "ip6-" + strings.Join(groups, "-") + d.domain
+}
@@ -0,0 +1,83 @@
+package director
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Returns the addresses of the server in DNS, sorted.
+func serverAddrs(t *testing.T, d *Director, server string) string {
+	var addrs []string
+	for _, typ := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		rrs, err := d.gate.Query(typ, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rr := range rrs {
+			switch a := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, a.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, a.AAAA.String())
+			}
+		}
+	}
+	sort.Strings(addrs)
+	return strings.Join(addrs, " ")
+}
+
+func TestAddressesAreCountedByRegistrations(t *testing.T) {
+	const srvtype = "_bo._rest_http._tcp.cust.rxt."
+	const bo1, bo2 = "bo1._bo._rest_http._tcp.cust.rxt.", "bo2._bo._rest_http._tcp.cust.rxt."
+	d := newTestDirector()
+	reg := func(name string, port uint16, addrs ...string) func() error {
+		return func() error {
+			_, e := d.RegDnsSrv(srvtype, &DnsService{Name: name, Server: "h1.cust.rxt.", Port: port, Addresses: addrs})
+			return e
+		}
+	}
+	steps := []struct {
+		name  string
+		do    func() error
+		addrs string
+	}{
+		{"first registration", reg(bo1, 80, "10.0.0.1"), "10.0.0.1"},
+		{"another service of the server", reg(bo2, 80, "10.0.0.1", "fd00::1"), "10.0.0.1 fd00::1"},
+		{"another port of the server", reg(bo1, 81, "10.0.0.2"), "10.0.0.1 10.0.0.2 fd00::1"},
+		{"shared address is kept", func() error { return d.RmInstance(bo1, "h1.cust.rxt.", 80) }, "10.0.0.1 10.0.0.2 fd00::1"},
+		{"registered again without an address", reg(bo2, 80, "fd00::1"), "10.0.0.2 fd00::1"},
+		{"patched addresses", func() error {
+			_, e := d.UpdateDnsSrv(bo1, "h1.cust.rxt.", 81, &DnsServicePatch{Addresses: []string{"10.0.0.3"}})
+			return e
+		}, "10.0.0.3 fd00::1"},
+		{"service removed", func() error { return d.RmDnsSrv(srvtype, bo2) }, "10.0.0.3"},
+		{"last instance removed", func() error { return d.RmInstance(bo1, "h1.cust.rxt.", 81) }, ""},
+	}
+	for _, s := range steps {
+		if err := s.do(); err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+		if addrs := serverAddrs(t, d, "h1.cust.rxt."); addrs != s.addrs {
+			t.Errorf("%s: addresses '%s', want '%s'", s.name, addrs, s.addrs)
+		}
+	}
+}
+
+func TestAddressHost(t *testing.T) {
+	d := newTestDirector()
+	tests := []struct {
+		ip, host string
+	}{
+		{"10.0.0.1", "ip-10-0-0-1.cust.rxt."},
+		{"::ffff:10.0.0.1", "ip-10-0-0-1.cust.rxt."},
+		{"fd00::1", "ip6-fd00-0000-0000-0000-0000-0000-0000-0001.cust.rxt."},
+	}
+	for _, tt := range tests {
+		if host := d.AddressHost(net.ParseIP(tt.ip)); host != tt.host {
+			t.Errorf("%s: %s, want %s", tt.ip, host, tt.host)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package director
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"git.reaxoft.loc/infomir/director/dnsgate"
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+)
+
+const ErrDirConflict = "director_conflict"
+
+// Matches any tag, i.e. the service name must have records.
+const AnyTag = "*"
+
+// The condition of a registration. If IfAbsent is set the instance is registered only if the
+// service name has no records yet. If IfMatch is set the params of the service are replaced only
+// if their tag is still the one returned by SrvTag.
+type RegCond struct {
+	IfAbsent bool
+	IfMatch  string
+}
+
+func (d *Director) applyCond(u *dnsgate.Update, srvname string, cond *RegCond) error {
+	if cond.IfAbsent {
+		u.Prereqs = append(u.Prereqs, dnsgate.NameNotUsed(srvname))
+	}
+	if cond.IfMatch == AnyTag {
+		u.Prereqs = append(u.Prereqs, dnsgate.NameUsed(srvname))
+	} else if cond.IfMatch != "" {
+		txts, err := d.gate.Query(dns.TypeTXT, srvname)
+		if err != nil {
+			return err
+		}
+		if tag := srvTag(txts); tag != cond.IfMatch {
+			return NewDirectorError(ErrDirConflict, "Service '%s' has been changed, its tag is %s", srvname, tag)
+		}
+		// the DNS server checks the params are still the same while the registration replaces them
+		if len(txts) == 0 {
+			u.Prereqs = append(u.Prereqs, dnsgate.RRsetNotUsed(srvname, dns.TypeTXT))
+		} else {
+			u.Prereqs = append(u.Prereqs, dnsgate.RRsetEquals(txts))
+		}
+	}
+	return nil
+}
+
+// Returns the tag of the service params, it changes whenever the params change.
+func (d *Director) SrvTag(srvname string) (string, error) {
+	csrvname := dotCanon(srvname)
+	if e := validateSrvName(strings.TrimSuffix(csrvname, d.domain)); e != nil {
+		return "", e
+	}
+	txts, err := d.gate.Query(dns.TypeTXT, csrvname)
+	if err != nil {
+		return "", err
+	}
+	return srvTag(txts), nil
+}
+
+func srvTag(txts []dns.RR) string {
+	var strs []string
+	for _, rr := range txts {
+		if t, ok := rr.(*dns.TXT); ok {
+			strs = append(strs, strings.Join(t.Txt, "\x00"))
+		}
+	}
+	sort.Strings(strs)
+	sum := sha1.Sum([]byte(strings.Join(strs, "\x01")))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
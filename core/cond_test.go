@@ -0,0 +1,51 @@
+package director
+
+import "testing"
+
+func TestRegDnsSrvIf(t *testing.T) {
+	const srvtype, name = "_bo._rest_http._tcp.cust.rxt.", "bo1._bo._rest_http._tcp.cust.rxt."
+	d := newTestDirector()
+	emptyTag, err := d.SrvTag(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tags before this step and before the previous one
+	var tag, prevTag string
+	steps := []struct {
+		name   string
+		server string
+		params map[string]string
+		cond   func() *RegCond
+		ok     bool
+	}{
+		{"any tag of a missing name", "h1.cust.rxt.", nil, func() *RegCond { return &RegCond{IfMatch: AnyTag} }, false},
+		{"absent", "h1.cust.rxt.", map[string]string{"v": "1"}, func() *RegCond { return &RegCond{IfAbsent: true} }, true},
+		{"absent again", "h2.cust.rxt.", nil, func() *RegCond { return &RegCond{IfAbsent: true} }, false},
+		{"any tag", "h2.cust.rxt.", map[string]string{"v": "1"}, func() *RegCond { return &RegCond{IfMatch: AnyTag} }, true},
+		{"tag of a missing name", "h3.cust.rxt.", nil, func() *RegCond { return &RegCond{IfMatch: emptyTag} }, false},
+		{"current tag", "h3.cust.rxt.", map[string]string{"v": "2"}, func() *RegCond { return &RegCond{IfMatch: tag} }, true},
+		// the params have been changed by the previous step
+		{"stale tag", "h4.cust.rxt.", map[string]string{"v": "3"}, func() *RegCond { return &RegCond{IfMatch: prevTag} }, false},
+	}
+	for _, s := range steps {
+		prevTag = tag
+		if tag, err = d.SrvTag(name); err != nil {
+			t.Fatal(err)
+		}
+		_, err := d.RegDnsSrvIf(srvtype, &DnsService{Name: name, Server: s.server, Port: 80, Params: s.params}, s.cond())
+		if s.ok && err != nil {
+			t.Errorf("%s: %v", s.name, err)
+		}
+		if de, ok := err.(*DirectorError); !s.ok && (!ok || de.Code != ErrDirConflict) {
+			t.Errorf("%s: want %s, got %v", s.name, ErrDirConflict, err)
+		}
+		next, _ := d.SrvTag(name)
+		if !s.ok && next != tag {
+			t.Errorf("%s: the tag has changed by a failed registration", s.name)
+		}
+	}
+	srvs, _ := d.FindDnsSrvInstances(name)
+	if len(srvs) != 3 {
+		t.Errorf("%d instances, want 3", len(srvs))
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"git.reaxoft.loc/infomir/director/dnsgate"
 	"git.reaxoft.loc/infomir/director/logger"
 	"github.com/miekg/dns"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"unicode"
 )
 
@@ -17,6 +19,7 @@ const (
 	ErrDirWrongSrvType   = "director_wrong_srv_type"
 	ErrDirWrongServer    = "director_wrong_server"
 	ErrDirWrongTxtString = "director_wrong_txt_string"
+	ErrDirInstNotFound   = "director_instance_not_found"
 )
 
 type DirectorError struct {
@@ -45,9 +48,16 @@ type Director struct {
 	gate   dnsgate.DnsGate
 	domain string
 	zone   string
+	store  *registry
+	leases *leaseTable
+	health *healthTable
+	events *eventLog
+	done   chan struct{}
+	// only the first call of Shutdown stops the director, later ones do nothing
+	shutdown sync.Once
 }
 
-func NewDirector(domain, server, keypath string) (*Director, error) {
+func NewDirector(domain, server string, gc *dnsgate.Config) (*Director, error) {
 	parts := strings.Split(server, ":")
 	var port uint16
 	if len(parts) == 2 {
@@ -57,13 +67,17 @@ func NewDirector(domain, server, keypath string) (*Director, error) {
 		}
 		port = uint16(u64)
 	} else {
-		port = 53
+		port = dnsgate.DefaultPort(gc.Net)
 	}
-	dg, e := dnsgate.NewPooledUdpDnsGate(parts[0], port, keypath)
+	dg, e := dnsgate.NewPooledDnsGate(parts[0], port, gc)
 	if e != nil {
 		return nil, e
 	}
+	return NewDirectorWithGate(domain, dg), nil
+}
 
+// Creates a director managing the domain through an arbitrary gate, e.g. dnsgate.NewMemDnsGate.
+func NewDirectorWithGate(domain string, dg dnsgate.DnsGate) *Director {
 	var zone = domain
 	if !strings.HasSuffix(zone, ".") {
 		zone = zone + "."
@@ -72,19 +86,52 @@ func NewDirector(domain, server, keypath string) (*Director, error) {
 	if !strings.HasPrefix(fqdn, ".") {
 		fqdn = "." + fqdn
 	}
-	return &Director{gate: dg, domain: fqdn, zone: zone}, nil
+	store, _ := newRegistry("")
+	return &Director{gate: dg, domain: fqdn, zone: zone, store: store, leases: newLeaseTable(), health: newHealthTable(), events: newEventLog(), done: make(chan struct{})}
+}
+
+// Keeps registrations in the file at path. Registrations already in the file are loaded,
+// call Reconcile to push them to DNS.
+func (d *Director) OpenStore(path string) error {
+	store, err := newRegistry(path)
+	if err != nil {
+		return err
+	}
+	d.store = store
+	// the leases start anew, so instances get a full lease to send a heartbeat after the restart
+	for _, reg := range store.all() {
+		if reg.LeaseId != "" {
+			d.leases.grant(reg.LeaseId, reg.LeaseTtl, reg.Name, reg.Server, reg.Port)
+		}
+		d.watchHealth(reg)
+	}
+	return nil
+}
+
+// Stops the lease reaper and health checks, releases resources of the gate, e.g. stops the embedded DNS server.
+func (d *Director) Shutdown() {
+	d.shutdown.Do(func() {
+		close(d.done)
+		if s, ok := d.gate.(interface {
+			Shutdown()
+		}); ok {
+			s.Shutdown()
+		}
+	})
 }
 
 func (d *Director) attachSrvToType(srvType, srvName string, ttl uint32) (*dns.PTR, error) {
-	if !strings.HasSuffix(srvName, srvType) {
-		return nil, NewDirectorError(ErrDirWrongSrvName, "Service name must end with a service type")
+	// the name is exactly one label under the type, so it can not reach into another type
+	label := strings.TrimSuffix(srvName, "."+srvType)
+	if label == srvName || strings.Contains(label, ".") {
+		return nil, NewDirectorError(ErrDirWrongSrvName, "Service name '%s' must be one label under the service type '%s'", srvName, srvType)
 	}
 
 	if e := validateSrvType(strings.TrimSuffix(srvType, d.domain)); e != nil {
 		return nil, e
 	}
 
-	if e := validateSrvNameWithoutType(strings.TrimSuffix(srvName, "."+srvType)); e != nil {
+	if e := validateSrvNameWithoutType(label); e != nil {
 		return nil, e
 	}
 
@@ -136,7 +183,14 @@ func (d *Director) addServRules(srvName string, params map[string]string) (*dns.
 		str = make([]string, 1, len(params))
 		var fullLen = 0
 		var strLen int
-		for k, v := range params {
+		// keys are sorted so the same params always give the same TXT record
+		keys := make([]string, 0, len(params))
+		for k := range params {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := params[k]
 			if len(k) < 1 || len(k) > 9 {
 				return nil, NewDirectorError(ErrDirWrongTxtString, "TXT key must have length between 1 and 9")
 			}
@@ -256,23 +310,49 @@ func (d *Director) findSrv(srvName string) ([]*dns.SRV, map[string]string, error
 		}
 	}
 
-	var params map[string]string = nil
-	if txt != nil {
-		params := make(map[string]string, len(txt.Txt))
-		for _, s := range txt.Txt {
-			if s != "" {
-				kv := strings.SplitN(s, "=", 2)
-				if _, ok := params[kv[0]]; !ok {
-					if len(kv) == 2 {
-						params[kv[0]] = kv[1]
-					} else {
-						params[kv[0]] = ""
-					}
+	return srvs, txtParams(txt), nil
+}
+
+// Parses key=value strings of the TXT record, nil TXT gives nil params.
+func txtParams(txt *dns.TXT) map[string]string {
+	if txt == nil {
+		return nil
+	}
+	params := make(map[string]string, len(txt.Txt))
+	for _, s := range txt.Txt {
+		if s != "" {
+			kv := strings.SplitN(s, "=", 2)
+			if _, ok := params[kv[0]]; !ok {
+				if len(kv) == 2 {
+					params[kv[0]] = kv[1]
+				} else {
+					params[kv[0]] = ""
 				}
 			}
 		}
 	}
-	return srvs, params, nil
+	return params
+}
+
+func storedRegs(reg *Registration) []*Registration {
+	if reg == nil {
+		return nil
+	}
+	return []*Registration{reg}
+}
+
+// Returns params from the TXT of the instance, nil if the instance has no TXT.
+func (d *Director) instParams(srvname, server string, port uint16) (map[string]string, error) {
+	rrs, err := d.gate.Query(dns.TypeTXT, d.instOwner(srvname, server, port))
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range rrs {
+		if t, ok := rr.(*dns.TXT); ok {
+			return txtParams(t), nil
+		}
+	}
+	return nil, nil
 }
 
 func (d *Director) findByType(srvType string) ([]*dns.PTR, error) {
@@ -294,14 +374,21 @@ func (d *Director) findByType(srvType string) ([]*dns.PTR, error) {
 	return ptrs, nil
 }
 
+// LeaseTtl is the lease duration in seconds requested on registration, zero means no lease.
+// State is the health state of a checked instance, it is reported by FindDnsSrvInstances only.
+// Addresses are IPv4 and IPv6 addresses of Server, director keeps A and AAAA records of Server
+// while any registered instance lists them.
 type DnsService struct {
-	Name     string            `json:"name"`
-	Server   string            `json:"server"`
-	Port     uint16            `json:"port"`
-	Ttl      uint32            `json:"Ttl"`
-	Priority uint16            `json:"priority"`
-	Weight   uint16            `json:"weight"`
-	Params   map[string]string `json:"params"`
+	Name      string            `json:"name"`
+	Server    string            `json:"server"`
+	Port      uint16            `json:"port"`
+	Ttl       uint32            `json:"Ttl"`
+	Priority  uint16            `json:"priority"`
+	Weight    uint16            `json:"weight"`
+	Params    map[string]string `json:"params"`
+	LeaseTtl  uint32            `json:"lease_ttl,omitempty"`
+	State     string            `json:"state,omitempty"`
+	Addresses []string          `json:"addresses,omitempty"`
 }
 
 func dotCanon(s string) string {
@@ -311,44 +398,246 @@ func dotCanon(s string) string {
 	return s
 }
 
-func (d *Director) RegDnsSrv(srvtype string, srv *DnsService) error {
+// Validates the service and builds the canonical registration with its DNS records. The TXT of
+// the service name is not among them, it is kept in the registration, see replaceSrvTxt.
+func (d *Director) newRegistration(srvtype string, srv *DnsService) (*Registration, []dns.RR, error) {
 	csrvtype := dotCanon(srvtype)
 	if !strings.HasSuffix(csrvtype, d.domain) {
 		logger.Error("service type '%s' does not end with '%s' domain", srvtype, d.domain)
-		return NewDirectorError(ErrDirWrongSrvType, "service type '%s' does not end with '%s' domain", srvtype, d.domain)
+		return nil, nil, NewDirectorError(ErrDirWrongSrvType, "service type '%s' does not end with '%s' domain", srvtype, d.domain)
 	}
 
 	csrvname := dotCanon(srv.Name)
 	if !strings.HasSuffix(csrvname, d.domain) {
 		logger.Error("service name '%s' does not end with '%s' domain", srv.Name, d.domain)
-		return NewDirectorError(ErrDirWrongSrvName, "service name '%s' does not end with '%s' domain", srv.Name, d.domain)
+		return nil, nil, NewDirectorError(ErrDirWrongSrvName, "service name '%s' does not end with '%s' domain", srv.Name, d.domain)
 	}
 
 	cserver := dotCanon(srv.Server)
 	if !strings.HasSuffix(cserver, d.domain) {
 		logger.Error("server '%s' does not end with '%s' domain", srv.Server, d.domain)
-		return NewDirectorError(ErrDirWrongServer, "server '%s' does not end with '%s' domain", srv.Server, d.domain)
+		return nil, nil, NewDirectorError(ErrDirWrongServer, "server '%s' does not end with '%s' domain", srv.Server, d.domain)
 	}
 
 	rPtr, err := d.attachSrvToType(csrvtype, csrvname, srv.Ttl)
 	if err != nil {
 		logger.Error("Attach service to type failed: %s", err.Error())
-		return err
+		return nil, nil, err
 	}
 	rSrv, err := d.assignSrvToServer(csrvname, cserver, srv.Port, srv.Ttl, srv.Priority, srv.Weight)
 	if err != nil {
 		logger.Error("Assign service to server failed: %s", err.Error())
-		return err
+		return nil, nil, err
 	}
 
-	params := srv.Params
+	if _, err := parseCheck(srv.Params); err != nil {
+		logger.Error("Health check of '%s' is misconfigured: %s", csrvname, err.Error())
+		return nil, nil, err
+	}
+
+	params := make(map[string]string, len(srv.Params)+1)
+	for k, v := range srv.Params {
+		params[k] = v
+	}
 	params["txtvers"] = "1"
 	rTxt, err := d.addServRules(csrvname, params)
 	if err != nil {
 		logger.Error("Add service rules failed: %s", err.Error())
-		return err
+		return nil, nil, err
+	}
+
+	rInstTxt := dns.Copy(rTxt)
+	rInstTxt.Header().Name = d.instOwner(csrvname, cserver, srv.Port)
+
+	rAddrs, addrs, err := addressRRs(cserver, srv.Ttl, srv.Addresses)
+	if err != nil {
+		logger.Error("Adding addresses of '%s' failed: %s", cserver, err.Error())
+		return nil, nil, err
+	}
+
+	reg := &Registration{Type: csrvtype, DnsService: *srv, srvTxt: rTxt}
+	reg.Name, reg.Server, reg.Params, reg.State, reg.Addresses = csrvname, cserver, params, "", addrs
+	return reg, append([]dns.RR{d.metaPtr(csrvtype), rPtr, rSrv, rInstTxt}, rAddrs...), nil
+}
+
+// Replaces the TXT of the service name with txt by the update, nil txt just removes it.
+// The service name keeps one TXT, the one of the last registered instance.
+func replaceSrvTxt(u *dnsgate.Update, srvname string, txt *dns.TXT) {
+	u.RemoveRRsets = append(u.RemoveRRsets, &dns.TXT{Hdr: dns.RR_Header{Name: srvname, Rrtype: dns.TypeTXT}})
+	if txt != nil {
+		u.Insert = append(u.Insert, txt)
+	}
+}
+
+// Returns the TXT the service name keeps once the instance at server:port is removed: the TXT
+// of another instance, or nil if no other instance is left.
+func (d *Director) remainingSrvTxt(srvname, server string, port uint16) (*dns.TXT, error) {
+	rsrvs, err := d.gate.Query(dns.TypeSRV, srvname)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range rsrvs {
+		t, ok := rr.(*dns.SRV)
+		if !ok || strings.EqualFold(t.Target, server) && t.Port == port {
+			continue
+		}
+		params, err := d.instParams(srvname, t.Target, t.Port)
+		if err != nil {
+			return nil, err
+		}
+		if params == nil {
+			// instances registered before params were kept per instance have only the service TXT
+			txts, err := d.gate.Query(dns.TypeTXT, srvname)
+			if err != nil || len(txts) == 0 {
+				return nil, err
+			}
+			return txts[0].(*dns.TXT), nil
+		}
+		return d.addServRules(srvname, params)
 	}
-	return d.gate.Add(d.zone, []dns.RR{rPtr, rSrv, rTxt})
+	// withdrawn instances are not in DNS, but they are still registered
+	for _, reg := range d.store.all() {
+		if strings.EqualFold(reg.Name, srvname) && reg.key() != instanceKey(srvname, server, port) {
+			return d.addServRules(srvname, reg.Params)
+		}
+	}
+	return nil, nil
+}
+
+// The DNS-SD name enumerating service types of the domain (RFC 6763 section 9).
+func (d *Director) metaName() string {
+	return "_services._dns-sd._udp" + d.domain
+}
+
+func (d *Director) metaPtr(srvtype string) *dns.PTR {
+	ptr := new(dns.PTR)
+	ptr.Hdr = dns.RR_Header{d.metaName(), dns.TypePTR, dns.ClassINET, 0, 0}
+	ptr.Ptr = srvtype
+	return ptr
+}
+
+// Returns the owner name of the instance TXT: "_<port>.<server without domain>._inst.<service name>".
+// The service name keeps a TXT as well, DNS-SD browsers look for it there.
+func (d *Director) instOwner(srvname, server string, port uint16) string {
+	return "_" + strconv.FormatUint(uint64(port), 10) + "." + strings.TrimSuffix(dotCanon(server), d.domain) + "._inst." + srvname
+}
+
+// Returns the RR for removing the TXT RRset of the instance.
+func (d *Director) instTxtRRset(srvname, server string, port uint16) dns.RR {
+	return &dns.TXT{Hdr: dns.RR_Header{Name: d.instOwner(srvname, server, port), Rrtype: dns.TypeTXT}}
+}
+
+// Registers the service instance. If srv.LeaseTtl is not zero the instance gets a lease
+// which must be renewed with RenewLease, otherwise nil lease is returned.
+func (d *Director) RegDnsSrv(srvtype string, srv *DnsService) (*Lease, error) {
+	return d.RegDnsSrvIf(srvtype, srv, nil)
+}
+
+// Registers the service instance if the condition is met, otherwise returns ErrDirConflict.
+// The condition is checked by the DNS server within the update, so concurrent registrations
+// of the same name can not overwrite each other.
+func (d *Director) RegDnsSrvIf(srvtype string, srv *DnsService, cond *RegCond) (*Lease, error) {
+	reg, rrs, err := d.newRegistration(srvtype, srv)
+	if err != nil {
+		return nil, err
+	}
+	u := &dnsgate.Update{RemoveRRsets: []dns.RR{d.instTxtRRset(reg.Name, reg.Server, reg.Port)}, Insert: rrs}
+	replaceSrvTxt(u, reg.Name, reg.srvTxt)
+	if prev := d.store.get(reg.Name, reg.Server, reg.Port); prev != nil {
+		u.Remove = d.unusedAddrs([]*Registration{prev}, []*Registration{reg})
+	}
+	if cond != nil {
+		if err := d.applyCond(u, reg.Name, cond); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.update(u); err != nil {
+		return nil, err
+	}
+	lease := d.registered(reg)
+	if err := d.store.put(reg); err != nil {
+		logger.Error("Storing registration of '%s' failed: %s", reg.Name, err.Error())
+		return nil, err
+	}
+	return lease, nil
+}
+
+// Sends the update to the gate, a failed prerequisite is reported as ErrDirConflict.
+func (d *Director) update(u *dnsgate.Update) error {
+	err := d.gate.Update(d.zone, u)
+	if de, ok := err.(*dnsgate.DnsError); ok && de.Code == dnsgate.ErrDnsPrereqFailed {
+		return NewDirectorError(ErrDirConflict, "Condition of the update is not met: %s", de.Msg)
+	}
+	return err
+}
+
+// Registers all the service instances with one DNS update, so either all or none of them are
+// registered. Every registration is validated before the update is sent. Returns leases in the
+// order of the registrations, nil for registrations without a lease.
+func (d *Director) RegDnsSrvBatch(batch []*Registration) ([]*Lease, error) {
+	regs := make([]*Registration, len(batch))
+	var rrs, instTxts []dns.RR
+	var prevs []*Registration
+	// the last registration of a name gives its service TXT
+	srvTxts := make(map[string]*dns.TXT)
+	var srvnames []string
+	for i, b := range batch {
+		if b == nil {
+			return nil, NewDirectorError(ErrDirWrongSrvName, "Registration %d is empty", i)
+		}
+		reg, brrs, err := d.newRegistration(b.Type, &b.DnsService)
+		if err != nil {
+			if de, ok := err.(*DirectorError); ok {
+				return nil, NewDirectorError(de.Code, "Registration %d: %s", i, de.Msg)
+			}
+			return nil, err
+		}
+		regs[i] = reg
+		rrs = append(rrs, brrs...)
+		if _, ok := srvTxts[reg.Name]; !ok {
+			srvnames = append(srvnames, reg.Name)
+		}
+		srvTxts[reg.Name] = reg.srvTxt
+		instTxts = append(instTxts, d.instTxtRRset(reg.Name, reg.Server, reg.Port))
+		if prev := d.store.get(reg.Name, reg.Server, reg.Port); prev != nil {
+			prevs = append(prevs, prev)
+		}
+	}
+	if len(rrs) == 0 {
+		return []*Lease{}, nil
+	}
+	u := &dnsgate.Update{Remove: d.unusedAddrs(prevs, regs), RemoveRRsets: instTxts, Insert: rrs}
+	for _, name := range srvnames {
+		replaceSrvTxt(u, name, srvTxts[name])
+	}
+	if err := d.update(u); err != nil {
+		return nil, err
+	}
+
+	leases := make([]*Lease, len(regs))
+	for i, reg := range regs {
+		leases[i] = d.registered(reg)
+	}
+	if err := d.store.put(regs...); err != nil {
+		logger.Error("Storing registrations failed: %s", err.Error())
+		return nil, err
+	}
+	return leases, nil
+}
+
+// Publishes events, grants the lease and starts the health check of the instance added to DNS.
+func (d *Director) registered(reg *Registration) *Lease {
+	d.events.publish(ptrEvent(EventAdd, reg.Type, reg.Name), srvEvent(EventAdd, reg.Type, reg.Name, reg.Server, reg.Port))
+
+	var lease *Lease
+	if reg.LeaseTtl != 0 {
+		reg.LeaseId = newLeaseId()
+		lease = d.leases.grant(reg.LeaseId, reg.LeaseTtl, reg.Name, reg.Server, reg.Port)
+	} else {
+		d.leases.revoke(reg.Name, reg.Server, reg.Port)
+	}
+	d.watchHealth(reg)
+	return lease
 }
 
 func (d *Director) RmDnsSrv(srvtype, srvname string) error {
@@ -364,7 +653,7 @@ func (d *Director) RmDnsSrv(srvtype, srvname string) error {
 		return NewDirectorError(ErrDirWrongSrvName, "service name '%s' does not end with '%s' domain", srvname, d.domain)
 	}
 
-	if !strings.HasSuffix(csrvname, srvtype) {
+	if !strings.HasSuffix(csrvname, "."+csrvtype) {
 		return NewDirectorError(ErrDirWrongSrvName, "Service name must end with a service type")
 	}
 
@@ -379,7 +668,48 @@ func (d *Director) RmDnsSrv(srvtype, srvname string) error {
 	ptr := new(dns.PTR)
 	ptr.Hdr = dns.RR_Header{csrvtype, dns.TypePTR, dns.ClassINET, 0, 0}
 	ptr.Ptr = csrvname
-	return d.gate.Remove(d.zone, csrvname, []dns.RR{ptr})
+	u := &dnsgate.Update{Remove: []dns.RR{ptr}, RemoveNames: []string{csrvname}}
+	evs := []*Event{ptrEvent(EventRemove, csrvtype, csrvname)}
+	// TXTs of instances in DNS and of withdrawn ones
+	rsrvs, err := d.gate.Query(dns.TypeSRV, csrvname)
+	if err != nil {
+		return err
+	}
+	for _, rr := range rsrvs {
+		if t, ok := rr.(*dns.SRV); ok {
+			u.RemoveNames = append(u.RemoveNames, d.instOwner(csrvname, t.Target, t.Port))
+		}
+	}
+	var removed []*Registration
+	for _, reg := range d.store.all() {
+		if strings.EqualFold(reg.Name, csrvname) {
+			u.RemoveNames = append(u.RemoveNames, d.instOwner(csrvname, reg.Server, reg.Port))
+			evs = append(evs, srvEvent(EventRemove, reg.Type, reg.Name, reg.Server, reg.Port))
+			removed = append(removed, reg)
+		}
+	}
+	u.Remove = append(u.Remove, d.unusedAddrs(removed, nil)...)
+	if err := d.update(u); err != nil {
+		return err
+	}
+	// the type is no longer enumerated once its last name is removed
+	if _, err := d.removeUnreferenced(csrvtype, dns.TypePTR, d.metaPtr(csrvtype)); err != nil {
+		logger.Error("Removing type '%s' from DNS-SD enumeration failed: %s", csrvtype, err.Error())
+	}
+	d.events.publish(evs...)
+	d.leases.revokeName(csrvname)
+	d.health.unwatchName(csrvname)
+	return d.store.removeName(csrvname)
+}
+
+// Removes rr by an update made only if name owns no RRset of the type, so a PTR is removed only
+// once nothing is left under the name it points to. Reports whether rr has been removed.
+func (d *Director) removeUnreferenced(name string, typ uint16, rr dns.RR) (bool, error) {
+	err := d.update(&dnsgate.Update{Prereqs: []dnsgate.Prereq{dnsgate.RRsetNotUsed(name, typ)}, Remove: []dns.RR{rr}})
+	if de, ok := err.(*DirectorError); ok && de.Code == ErrDirConflict {
+		return false, nil
+	}
+	return err == nil, err
 }
 
 func (d *Director) RmInstance(srvname, server string, port uint16) error {
@@ -403,7 +733,161 @@ func (d *Director) RmInstance(srvname, server string, port uint16) error {
 	srv.Hdr = dns.RR_Header{csrvname, dns.TypeSRV, dns.ClassINET, 0, 0}
 	srv.Target = cserver
 	srv.Port = port
-	return d.gate.Remove(d.zone, "", []dns.RR{srv})
+	u := &dnsgate.Update{Remove: []dns.RR{srv}, RemoveNames: []string{d.instOwner(csrvname, cserver, port)}}
+	txt, err := d.remainingSrvTxt(csrvname, cserver, port)
+	if err != nil {
+		return err
+	}
+	replaceSrvTxt(u, csrvname, txt)
+	var srvtype string
+	if reg := d.store.get(csrvname, cserver, port); reg != nil {
+		srvtype = reg.Type
+		u.Remove = append(u.Remove, d.unusedAddrs([]*Registration{reg}, nil)...)
+	}
+	if err := d.update(u); err != nil {
+		return err
+	}
+	d.events.publish(srvEvent(EventRemove, srvtype, csrvname, cserver, port))
+	d.leases.revoke(csrvname, cserver, port)
+	d.health.unwatch(csrvname, cserver, port)
+	return d.store.removeInstance(csrvname, cserver, port)
+}
+
+// Changes of a registered instance, nil fields are left as they are. Params replace all params
+// of the instance, Addresses replace all its addresses.
+type DnsServicePatch struct {
+	Port      *uint16           `json:"port,omitempty"`
+	Ttl       *uint32           `json:"Ttl,omitempty"`
+	Priority  *uint16           `json:"priority,omitempty"`
+	Weight    *uint16           `json:"weight,omitempty"`
+	Params    map[string]string `json:"params,omitempty"`
+	Addresses []string          `json:"addresses,omitempty"`
+}
+
+// Changes the instance of the service at server:port in place: its SRV and the service TXT are
+// replaced in one update, so the service never lacks the instance. Returns the changed instance.
+func (d *Director) UpdateDnsSrv(srvname, server string, port uint16, patch *DnsServicePatch) (*DnsService, error) {
+	csrvname := dotCanon(srvname)
+	if !strings.HasSuffix(csrvname, d.domain) {
+		logger.Error("service name '%s' does not end with '%s' domain", srvname, d.domain)
+		return nil, NewDirectorError(ErrDirWrongSrvName, "service name '%s' does not end with '%s' domain", srvname, d.domain)
+	}
+
+	if e := validateSrvName(strings.TrimSuffix(csrvname, d.domain)); e != nil {
+		return nil, e
+	}
+
+	cserver := dotCanon(server)
+	rrs, err := d.gate.Query(dns.TypeANY, csrvname)
+	if err != nil {
+		return nil, err
+	}
+	var old *dns.SRV
+	var srvs, txts []dns.RR
+	for _, rr := range rrs {
+		switch t := rr.(type) {
+		case *dns.SRV:
+			srvs = append(srvs, t)
+			if strings.EqualFold(t.Target, cserver) && t.Port == port {
+				old = t
+			}
+		case *dns.TXT:
+			txts = append(txts, t)
+		}
+	}
+	if old == nil {
+		return nil, NewDirectorError(ErrDirInstNotFound, "Instance of '%s' at '%s:%d' not found", csrvname, cserver, port)
+	}
+
+	// the type of a registered service name is the name without its first label
+	srvtype := csrvname[strings.Index(csrvname, ".")+1:]
+	srv := DnsService{Name: csrvname, Server: cserver, Port: old.Port, Ttl: old.Hdr.Ttl, Priority: old.Priority, Weight: old.Weight}
+	if params, err := d.instParams(csrvname, cserver, port); err != nil {
+		return nil, err
+	} else if params != nil {
+		srv.Params = params
+	} else if len(txts) > 0 {
+		srv.Params = txtParams(txts[0].(*dns.TXT))
+	}
+	stored := d.store.get(csrvname, cserver, port)
+	if stored != nil {
+		srvtype, srv.LeaseTtl, srv.Addresses = stored.Type, stored.LeaseTtl, stored.Addresses
+	}
+	if patch.Port != nil {
+		srv.Port = *patch.Port
+	}
+	if patch.Ttl != nil {
+		srv.Ttl = *patch.Ttl
+	}
+	if patch.Priority != nil {
+		srv.Priority = *patch.Priority
+	}
+	if patch.Weight != nil {
+		srv.Weight = *patch.Weight
+	}
+	if patch.Params != nil {
+		srv.Params = patch.Params
+	}
+	if patch.Addresses != nil {
+		srv.Addresses = patch.Addresses
+	}
+
+	reg, nrrs, err := d.newRegistration(srvtype, &srv)
+	if err != nil {
+		return nil, err
+	}
+	u := &dnsgate.Update{
+		Prereqs:     []dnsgate.Prereq{dnsgate.RRsetEquals(srvs)},
+		Remove:      append([]dns.RR{old}, d.unusedAddrs(storedRegs(stored), []*Registration{reg})...),
+		RemoveNames: []string{d.instOwner(csrvname, cserver, port)},
+		Insert:      nrrs,
+	}
+	replaceSrvTxt(u, csrvname, reg.srvTxt)
+	if len(txts) > 0 {
+		u.Prereqs = append(u.Prereqs, dnsgate.RRsetEquals(txts))
+	} else {
+		u.Prereqs = append(u.Prereqs, dnsgate.RRsetNotUsed(csrvname, dns.TypeTXT))
+	}
+	if err := d.update(u); err != nil {
+		return nil, err
+	}
+	d.events.publish(srvEvent(EventRemove, reg.Type, csrvname, cserver, port), srvEvent(EventAdd, reg.Type, reg.Name, reg.Server, reg.Port))
+
+	// the lease and the health check follow the instance
+	if stored != nil && stored.LeaseId != "" {
+		reg.LeaseId = stored.LeaseId
+		d.leases.revoke(csrvname, cserver, port)
+		d.leases.grant(reg.LeaseId, reg.LeaseTtl, reg.Name, reg.Server, reg.Port)
+	}
+	d.health.unwatch(csrvname, cserver, port)
+	d.watchHealth(reg)
+	if reg.key() != instanceKey(csrvname, cserver, port) {
+		if err := d.store.removeInstance(csrvname, cserver, port); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.store.put(reg); err != nil {
+		logger.Error("Storing registration of '%s' failed: %s", reg.Name, err.Error())
+		return nil, err
+	}
+	return &reg.DnsService, nil
+}
+
+// Returns the service types of the domain.
+func (d *Director) FindDnsSrvTypes() ([]string, error) {
+	rrs, err := d.gate.Query(dns.TypePTR, d.metaName())
+	if err != nil {
+		logger.Error("Finding service types error: %s", err.Error())
+		return nil, err
+	}
+
+	types := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		if t, ok := rr.(*dns.PTR); ok {
+			types = append(types, t.Ptr)
+		}
+	}
+	return types, nil
 }
 
 func (d *Director) FindDnsSrvNames(srvtype string) ([]string, error) {
@@ -431,14 +915,113 @@ func (d *Director) FindDnsSrvInstances(srvname string) ([]*DnsService, error) {
 	srvs := make([]*DnsService, len(rsrvs), len(rsrvs))
 	for i := range rsrvs {
 		h = rsrvs[i].Header()
+		// instances registered before params were kept per instance have only the service TXT
+		iparams, err := d.instParams(h.Name, rsrvs[i].Target, rsrvs[i].Port)
+		if err != nil {
+			logger.Error("Finding instance params error: %s", err.Error())
+			return nil, err
+		}
+		if iparams == nil {
+			iparams = params
+		}
 		srvs[i] = &DnsService{Name: h.Name,
 			Server:   rsrvs[i].Target,
 			Port:     rsrvs[i].Port,
 			Ttl:      h.Ttl,
 			Priority: rsrvs[i].Priority,
 			Weight:   rsrvs[i].Weight,
-			Params:   params,
+			Params:   iparams,
+			State:    d.health.state(h.Name, rsrvs[i].Target, rsrvs[i].Port),
+		}
+	}
+
+	// withdrawn instances are not in DNS, but they are still registered
+	for _, reg := range d.store.all() {
+		if strings.EqualFold(reg.Name, dotCanon(srvname)) && d.health.isWithdrawn(reg.Name, reg.Server, reg.Port) {
+			srv := reg.DnsService
+			srv.State = StateCritical
+			srvs = append(srvs, &srv)
 		}
 	}
 	return srvs, nil
 }
+
+// Pushes again the records of stored registrations which are missing in DNS, e.g. after
+// the DNS server has lost its journal. Returns the number of repaired registrations.
+func (d *Director) Reconcile() (int, error) {
+	var repaired int
+	var lastErr error
+	for _, reg := range d.store.all() {
+		if d.health.isWithdrawn(reg.Name, reg.Server, reg.Port) {
+			continue
+		}
+		sreg, rrs, err := d.newRegistration(reg.Type, &reg.DnsService)
+		if err != nil {
+			logger.Error("Stored registration of '%s' is invalid: %s", reg.Name, err.Error())
+			lastErr = err
+			continue
+		}
+		// any instance may give the service TXT, it is missing only if it has none
+		txts, err := d.gate.Query(dns.TypeTXT, reg.Name)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(txts) == 0 {
+			rrs = append(rrs, sreg.srvTxt)
+		}
+
+		present, err := d.queryRRsets(rrs)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if containsAll(present, rrs) {
+			continue
+		}
+
+		logger.Info("Records of '%s' at '%s:%d' are missing in DNS, pushing them again", reg.Name, reg.Server, reg.Port)
+		if err := d.gate.Add(d.zone, rrs); err != nil {
+			lastErr = err
+			continue
+		}
+		repaired++
+	}
+	return repaired, lastErr
+}
+
+// Returns the RRsets of the names and types of rrs.
+func (d *Director) queryRRsets(rrs []dns.RR) ([]dns.RR, error) {
+	var present []dns.RR
+	queried := make(map[string]bool)
+	for _, rr := range rrs {
+		h := rr.Header()
+		key := strings.ToLower(h.Name) + "|" + dns.TypeToString[h.Rrtype]
+		if queried[key] {
+			continue
+		}
+		queried[key] = true
+		rrset, err := d.gate.Query(h.Rrtype, h.Name)
+		if err != nil {
+			return nil, err
+		}
+		present = append(present, rrset...)
+	}
+	return present, nil
+}
+
+func containsAll(rrs []dns.RR, wanted []dns.RR) bool {
+	for _, w := range wanted {
+		found := false
+		for _, rr := range rrs {
+			if dns.IsDuplicate(rr, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,314 @@
+package director
+
+import (
+	"git.reaxoft.loc/infomir/director/dnsgate"
+	"github.com/miekg/dns"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func newTestDirector() *Director {
+	return NewDirectorWithGate("cust.rxt", dnsgate.NewMemDnsGate())
+}
+
+func TestRegDnsSrvNameUnderType(t *testing.T) {
+	tests := []struct {
+		srvtype, name string
+		ok            bool
+	}{
+		{"_bo._rest_http._tcp.cust.rxt", "bo1._bo._rest_http._tcp.cust.rxt", true},
+		{"_bo._rest_http._tcp.cust.rxt.", "bo1._bo._rest_http._tcp.cust.rxt.", true},
+		// another type of the same domain
+		{"_bo._rest_http._tcp.cust.rxt", "bo1._billing._rest_http._tcp.cust.rxt", false},
+		// a shorter type the name of another type ends with
+		{"_rest_http._tcp.cust.rxt", "bo1._billing._rest_http._tcp.cust.rxt", false},
+		// the type is a suffix of a label of the name only
+		{"_bo._tcp.cust.rxt", "bo1.x_bo._tcp.cust.rxt", false},
+		// more than one label under the type
+		{"_bo._tcp.cust.rxt", "a.bo1._bo._tcp.cust.rxt", false},
+		{"_bo._tcp.cust.rxt", "_bo._tcp.cust.rxt", false},
+	}
+	for _, tt := range tests {
+		d := newTestDirector()
+		_, err := d.RegDnsSrv(tt.srvtype, &DnsService{Name: tt.name, Server: "h1.cust.rxt", Port: 80})
+		if tt.ok && err != nil {
+			t.Errorf("RegDnsSrv(%s, %s) failed: %s", tt.srvtype, tt.name, err)
+		}
+		if !tt.ok {
+			if de, isDe := err.(*DirectorError); !isDe || de.Code != ErrDirWrongSrvName {
+				t.Errorf("RegDnsSrv(%s, %s) = %v, want %s", tt.srvtype, tt.name, err, ErrDirWrongSrvName)
+			}
+		}
+	}
+}
+
+func TestRegDnsSrvBatchNameUnderType(t *testing.T) {
+	d := newTestDirector()
+	batch := []*Registration{
+		{Type: "_bo._tcp.cust.rxt", DnsService: DnsService{Name: "bo1._bo._tcp.cust.rxt", Server: "h1.cust.rxt", Port: 80}},
+		{Type: "_bo._tcp.cust.rxt", DnsService: DnsService{Name: "bo1._billing._tcp.cust.rxt", Server: "h1.cust.rxt", Port: 80}},
+	}
+	if _, err := d.RegDnsSrvBatch(batch); err == nil {
+		t.Fatal("batch with a name of another type is registered")
+	}
+	if names, _ := d.FindDnsSrvNames("_billing._tcp.cust.rxt"); len(names) != 0 {
+		t.Errorf("names of _billing._tcp: %v, want none", names)
+	}
+}
+
+func TestRegDnsSrvBatch(t *testing.T) {
+	const srvtype = "_bo._rest_http._tcp.cust.rxt."
+	all := func(*Event) bool { return true }
+	tests := []struct {
+		name  string
+		batch []*Registration
+		ok    bool
+	}{
+		{"valid", []*Registration{
+			{Type: srvtype, DnsService: DnsService{Name: "bo1." + srvtype, Server: "h1.cust.rxt.", Port: 80, LeaseTtl: 30}},
+			{Type: srvtype, DnsService: DnsService{Name: "bo2." + srvtype, Server: "h2.cust.rxt.", Port: 80, Addresses: []string{"10.0.0.2"}}},
+		}, true},
+		{"mixed", []*Registration{
+			{Type: srvtype, DnsService: DnsService{Name: "bo1." + srvtype, Server: "h1.cust.rxt.", Port: 80, LeaseTtl: 30}},
+			{Type: srvtype, DnsService: DnsService{Name: "bo2." + srvtype, Server: "h2.cust.rxt.", Port: 80, Addresses: []string{"not an address"}}},
+		}, false},
+	}
+	for _, tt := range tests {
+		d := newTestDirector()
+		leases, err := d.RegDnsSrvBatch(tt.batch)
+		if tt.ok != (err == nil) {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		evs, _, _, _ := d.events.since(0, all)
+		if !tt.ok {
+			if n := countRRs(t, d, dns.TypeSRV, "bo1."+srvtype) + countRRs(t, d, dns.TypePTR, srvtype) + countRRs(t, d, dns.TypeA, "h2.cust.rxt."); n != 0 {
+				t.Errorf("%s: %d records are left", tt.name, n)
+			}
+			if regs := d.store.all(); len(regs) != 0 || len(evs) != 0 {
+				t.Errorf("%s: stored %v, published %v", tt.name, regs, evs)
+			}
+			continue
+		}
+
+		if len(leases) != 2 || leases[0] == nil || leases[1] != nil {
+			t.Errorf("%s: leases %v, want one for bo1 only", tt.name, leases)
+		}
+		for _, reg := range tt.batch {
+			if n := countRRs(t, d, dns.TypeSRV, reg.Name); n != 1 {
+				t.Errorf("%s: %d SRVs of %s", tt.name, n, reg.Name)
+			}
+			if d.store.get(reg.Name, reg.Server, reg.Port) == nil {
+				t.Errorf("%s: %s is not stored", tt.name, reg.Name)
+			}
+		}
+		if n := countRRs(t, d, dns.TypeA, "h2.cust.rxt."); n != 1 {
+			t.Errorf("%s: %d addresses of h2", tt.name, n)
+		}
+		// a PTR and an SRV event for every registration
+		if len(evs) != 4 {
+			t.Errorf("%s: events %v", tt.name, evs)
+		}
+	}
+}
+
+// Returns the params of the TXTs of the service name.
+func srvTxtParams(t *testing.T, d *Director, srvname string) []map[string]string {
+	rrs, err := d.gate.Query(dns.TypeTXT, srvname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var params []map[string]string
+	for _, rr := range rrs {
+		params = append(params, txtParams(rr.(*dns.TXT)))
+	}
+	return params
+}
+
+func TestSrvTxtFollowsInstances(t *testing.T) {
+	const srvtype, name = "_bo._rest_http._tcp.cust.rxt.", "bo1._bo._rest_http._tcp.cust.rxt."
+	d := newTestDirector()
+	steps := []struct {
+		do      func() error
+		version string
+	}{
+		{func() error {
+			_, e := d.RegDnsSrv(srvtype, &DnsService{Name: name, Server: "h1.cust.rxt", Port: 80, Params: map[string]string{"v": "1"}})
+			return e
+		}, "1"},
+		{func() error {
+			_, e := d.RegDnsSrv(srvtype, &DnsService{Name: name, Server: "h2.cust.rxt", Port: 80, Params: map[string]string{"v": "2"}})
+			return e
+		}, "2"},
+		{func() error { return d.RmInstance(name, "h2.cust.rxt", 80) }, "1"},
+		{func() error {
+			_, e := d.RegDnsSrvBatch([]*Registration{
+				{Type: srvtype, DnsService: DnsService{Name: name, Server: "h3.cust.rxt", Port: 80, Params: map[string]string{"v": "3"}}},
+				{Type: srvtype, DnsService: DnsService{Name: name, Server: "h4.cust.rxt", Port: 80, Params: map[string]string{"v": "4"}}},
+			})
+			return e
+		}, "4"},
+		{func() error { return d.RmInstance(name, "h1.cust.rxt", 80) }, ""},
+		{func() error { return d.RmInstance(name, "h3.cust.rxt", 80) }, ""},
+		{func() error { return d.RmInstance(name, "h4.cust.rxt", 80) }, ""},
+	}
+	for i, s := range steps {
+		if err := s.do(); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		params := srvTxtParams(t, d, name)
+		if i == len(steps)-1 {
+			if len(params) != 0 {
+				t.Errorf("step %d: service TXT is left after the last instance: %v", i, params)
+			}
+			continue
+		}
+		if len(params) != 1 {
+			t.Fatalf("step %d: want one service TXT, got %v", i, params)
+		}
+		if s.version != "" && params[0]["v"] != s.version {
+			t.Errorf("step %d: service TXT has v=%s, want %s", i, params[0]["v"], s.version)
+		}
+	}
+}
+
+func TestUpdateDnsSrv(t *testing.T) {
+	const srvtype, name = "_bo._rest_http._tcp.cust.rxt.", "bo1._bo._rest_http._tcp.cust.rxt."
+	d := newTestDirector()
+	params := map[string]string{"v": "1", CheckParam: CheckTcp, CheckIntervalParam: "3600"}
+	lease, err := d.RegDnsSrv(srvtype, &DnsService{Name: name, Server: "h1.cust.rxt.", Port: 80, LeaseTtl: 60, Params: params})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := uint16(8080)
+	patched := map[string]string{"v": "2", CheckParam: CheckTcp, CheckIntervalParam: "3600"}
+	srv, err := d.UpdateDnsSrv(name, "h1.cust.rxt", 80, &DnsServicePatch{Port: &port, Params: patched})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Port != port || srv.Params["v"] != "2" {
+		t.Errorf("updated instance %+v, want port %d and v=2", srv, port)
+	}
+	rrs, _ := d.gate.Query(dns.TypeSRV, name)
+	if len(rrs) != 1 || rrs[0].(*dns.SRV).Port != port {
+		t.Errorf("SRVs after the update: %v", rrs)
+	}
+	if params := srvTxtParams(t, d, name); len(params) != 1 || params[0]["v"] != "2" {
+		t.Errorf("service TXT after the update: %v", params)
+	}
+
+	// the lease and the health check follow the instance to the new port
+	if lname, server, err := d.LeaseInstance(lease.Id); err != nil || lname != name || server != "h1.cust.rxt." {
+		t.Errorf("lease holder %s %s %v", lname, server, err)
+	}
+	if _, err := d.RenewLease(lease.Id); err != nil {
+		t.Errorf("lease of the updated instance can not be renewed: %v", err)
+	}
+	if state := d.health.state(name, "h1.cust.rxt.", port); state != StatePassing {
+		t.Errorf("health state of the updated instance '%s', want %s", state, StatePassing)
+	}
+	if state := d.health.state(name, "h1.cust.rxt.", 80); state != "" {
+		t.Errorf("the old instance is still checked: %s", state)
+	}
+	if reg := d.store.get(name, "h1.cust.rxt.", port); reg == nil || reg.LeaseId != lease.Id {
+		t.Errorf("stored registration of the updated instance %+v", reg)
+	}
+	if reg := d.store.get(name, "h1.cust.rxt.", 80); reg != nil {
+		t.Errorf("the old instance is still stored: %+v", reg)
+	}
+
+	_, err = d.UpdateDnsSrv(name, "h1.cust.rxt", 80, &DnsServicePatch{Port: &port})
+	if de, ok := err.(*DirectorError); !ok || de.Code != ErrDirInstNotFound {
+		t.Errorf("update of an unknown instance: want %s, got %v", ErrDirInstNotFound, err)
+	}
+}
+
+// A gate which runs race once after the next query, as a change made concurrently by another client.
+type racingGate struct {
+	dnsgate.DnsGate
+	race func()
+}
+
+func (g *racingGate) Query(typ uint16, key string) ([]dns.RR, error) {
+	rrs, err := g.DnsGate.Query(typ, key)
+	if race := g.race; race != nil {
+		g.race = nil
+		race()
+	}
+	return rrs, err
+}
+
+func TestUpdateDnsSrvConflict(t *testing.T) {
+	const srvtype, name = "_bo._rest_http._tcp.cust.rxt.", "bo1._bo._rest_http._tcp.cust.rxt."
+	gate := &racingGate{DnsGate: dnsgate.NewMemDnsGate()}
+	d := NewDirectorWithGate("cust.rxt", gate)
+	if _, err := d.RegDnsSrv(srvtype, &DnsService{Name: name, Server: "h1.cust.rxt.", Port: 80}); err != nil {
+		t.Fatal(err)
+	}
+	gate.race = func() {
+		if _, err := d.RegDnsSrv(srvtype, &DnsService{Name: name, Server: "h2.cust.rxt.", Port: 80}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	port := uint16(8080)
+	_, err := d.UpdateDnsSrv(name, "h1.cust.rxt", 80, &DnsServicePatch{Port: &port})
+	if de, ok := err.(*DirectorError); !ok || de.Code != ErrDirConflict {
+		t.Fatalf("update after a concurrent change: want %s, got %v", ErrDirConflict, err)
+	}
+	rrs, _ := d.gate.Query(dns.TypeSRV, name)
+	ports := make(map[string]uint16)
+	for _, rr := range rrs {
+		ports[rr.(*dns.SRV).Target] = rr.(*dns.SRV).Port
+	}
+	if len(ports) != 2 || ports["h1.cust.rxt."] != 80 {
+		t.Errorf("SRVs after the conflict: %v", rrs)
+	}
+}
+
+func TestTypeEnumerationFollowsNames(t *testing.T) {
+	const bo, billing = "_bo._rest_http._tcp.cust.rxt.", "_billing._rest_http._tcp.cust.rxt."
+	d := newTestDirector()
+	for _, reg := range []struct{ srvtype, name string }{{bo, "bo1." + bo}, {bo, "bo2." + bo}, {billing, "b1." + billing}} {
+		if _, err := d.RegDnsSrv(reg.srvtype, &DnsService{Name: reg.name, Server: "h1.cust.rxt", Port: 80}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	steps := []struct {
+		srvtype, name string
+		types         []string
+	}{
+		{"", "", []string{billing, bo}},
+		// another name of the type is left
+		{bo, "bo1." + bo, []string{billing, bo}},
+		{bo, "bo2." + bo, []string{billing}},
+		{billing, "b1." + billing, nil},
+	}
+	for i, s := range steps {
+		if s.name != "" {
+			if err := d.RmDnsSrv(s.srvtype, s.name); err != nil {
+				t.Fatalf("step %d: %v", i, err)
+			}
+		}
+		types, err := d.FindDnsSrvTypes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(types)
+		if len(types) != len(s.types) || len(types) != 0 && !reflect.DeepEqual(types, s.types) {
+			t.Errorf("step %d: types %v, want %v", i, types, s.types)
+		}
+	}
+}
+
+func TestShutdownTwice(t *testing.T) {
+	d := newTestDirector()
+	d.Shutdown()
+	d.Shutdown()
+	select {
+	case <-d.done:
+	default:
+		t.Error("the director is not stopped")
+	}
+}
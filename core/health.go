@@ -0,0 +1,291 @@
+package director
+
+import (
+	"git.reaxoft.loc/infomir/director/dnsgate"
+	"git.reaxoft.loc/infomir/director/logger"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ErrDirWrongCheck = "director_wrong_check"
+
+// Params of a registration which configure its health check.
+const (
+	CheckParam          = "check"
+	CheckIntervalParam  = "check_int"
+	CheckThresholdParam = "check_thr"
+)
+
+// Kinds of health checks.
+const (
+	CheckTcp  = "tcp"
+	CheckHttp = "http"
+)
+
+// Health states of an instance.
+const (
+	StatePassing  = "passing"
+	StateFailing  = "failing"
+	StateCritical = "critical"
+)
+
+const (
+	defaultCheckInterval  = 10 * time.Second
+	defaultCheckThreshold = 3
+	maxCheckTimeout       = 5 * time.Second
+)
+
+type checkSpec struct {
+	kind      string
+	interval  time.Duration
+	threshold int
+}
+
+// Reads the health check settings from the params. Returns nil if the instance is not checked.
+func parseCheck(params map[string]string) (*checkSpec, error) {
+	kind, ok := params[CheckParam]
+	if !ok || kind == "" {
+		return nil, nil
+	}
+	if kind != CheckTcp && kind != CheckHttp {
+		return nil, NewDirectorError(ErrDirWrongCheck, "Check must be '%s' or '%s'", CheckTcp, CheckHttp)
+	}
+	spec := &checkSpec{kind: kind, interval: defaultCheckInterval, threshold: defaultCheckThreshold}
+	if v, ok := params[CheckIntervalParam]; ok {
+		sec, e := strconv.ParseUint(v, 10, 16)
+		if e != nil || sec == 0 {
+			return nil, NewDirectorError(ErrDirWrongCheck, "Check interval must be a positive number of seconds")
+		}
+		spec.interval = time.Duration(sec) * time.Second
+	}
+	if v, ok := params[CheckThresholdParam]; ok {
+		n, e := strconv.ParseUint(v, 10, 8)
+		if e != nil || n == 0 {
+			return nil, NewDirectorError(ErrDirWrongCheck, "Check threshold must be a positive number of failures")
+		}
+		spec.threshold = int(n)
+	}
+	return spec, nil
+}
+
+type checkState struct {
+	reg      *Registration
+	spec     *checkSpec
+	failures int
+	state    string
+	stop     chan struct{}
+}
+
+// The health checks of registered instances by instance key.
+type healthTable struct {
+	lock   sync.Mutex
+	checks map[string]*checkState
+}
+
+func newHealthTable() *healthTable {
+	return &healthTable{checks: make(map[string]*checkState)}
+}
+
+// Returns the health state of the instance, empty if it is not checked.
+func (ht *healthTable) state(name, server string, port uint16) string {
+	ht.lock.Lock()
+	defer ht.lock.Unlock()
+	if cs, ok := ht.checks[instanceKey(name, server, port)]; ok {
+		return cs.state
+	}
+	return ""
+}
+
+func (ht *healthTable) isWithdrawn(name, server string, port uint16) bool {
+	return ht.state(name, server, port) == StateCritical
+}
+
+func (ht *healthTable) unwatch(name, server string, port uint16) {
+	ht.lock.Lock()
+	defer ht.lock.Unlock()
+	ht.unwatchLocked(instanceKey(name, server, port))
+}
+
+func (ht *healthTable) unwatchLocked(key string) {
+	if cs, ok := ht.checks[key]; ok {
+		close(cs.stop)
+		delete(ht.checks, key)
+	}
+}
+
+func (ht *healthTable) unwatchName(name string) {
+	ht.lock.Lock()
+	defer ht.lock.Unlock()
+	for key, cs := range ht.checks {
+		if strings.EqualFold(cs.reg.Name, name) {
+			ht.unwatchLocked(key)
+		}
+	}
+}
+
+// Starts checking the registered instance if its params ask for it, a previous check of the instance is stopped.
+func (d *Director) watchHealth(reg *Registration) {
+	spec, _ := parseCheck(reg.Params)
+	d.health.lock.Lock()
+	defer d.health.lock.Unlock()
+	d.health.unwatchLocked(reg.key())
+	if spec == nil {
+		return
+	}
+	cs := &checkState{reg: reg, spec: spec, state: StatePassing, stop: make(chan struct{})}
+	d.health.checks[reg.key()] = cs
+	go d.runCheck(cs)
+}
+
+func (d *Director) runCheck(cs *checkState) {
+	t := time.NewTicker(cs.spec.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-cs.stop:
+			return
+		case <-t.C:
+			if !d.check(cs) {
+				return
+			}
+		}
+	}
+}
+
+// Probes the instance once and withdraws or reinstates it when its state changes. Returns false
+// if the instance has been unwatched meanwhile.
+func (d *Director) check(cs *checkState) bool {
+	err := probe(cs.reg, cs.spec)
+	d.health.lock.Lock()
+	select {
+	case <-cs.stop:
+		// unwatched while probing
+		d.health.lock.Unlock()
+		return false
+	default:
+	}
+	prev := cs.state
+	if err != nil {
+		cs.failures++
+		if cs.failures >= cs.spec.threshold {
+			cs.state = StateCritical
+		} else if prev != StateCritical {
+			cs.state = StateFailing
+		}
+	} else {
+		cs.failures = 0
+		cs.state = StatePassing
+	}
+	state := cs.state
+	d.health.lock.Unlock()
+
+	if err != nil && prev != StateCritical {
+		logger.Warn("Health check of '%s' at '%s:%d' failed: %s", cs.reg.Name, cs.reg.Server, cs.reg.Port, err.Error())
+	}
+	switch {
+	case prev != StateCritical && state == StateCritical:
+		logger.Warn("Withdrawing '%s' at '%s:%d' from DNS", cs.reg.Name, cs.reg.Server, cs.reg.Port)
+		d.withdraw(cs)
+	case prev == StateCritical && state == StatePassing:
+		logger.Info("'%s' at '%s:%d' recovered, adding it to DNS again", cs.reg.Name, cs.reg.Server, cs.reg.Port)
+		d.reinstate(cs)
+	}
+	return true
+}
+
+// Removes the records of the instance from DNS: its SRV, its TXT and the addresses no other instance
+// in DNS uses. The PTR of the service name goes once its last instance is withdrawn, so DNS-SD browsers
+// do not list it. The TXT of the service name is kept, the instance is still registered.
+func (d *Director) withdraw(cs *checkState) {
+	reg := cs.reg
+	srv := new(dns.SRV)
+	srv.Hdr = dns.RR_Header{reg.Name, dns.TypeSRV, dns.ClassINET, 0, 0}
+	srv.Target = reg.Server
+	srv.Port = reg.Port
+	u := &dnsgate.Update{
+		Remove:      append([]dns.RR{srv}, d.unusedAddrs([]*Registration{reg}, nil)...),
+		RemoveNames: []string{d.instOwner(reg.Name, reg.Server, reg.Port)},
+	}
+	if e := d.update(u); e != nil {
+		logger.Error("Withdrawing '%s' failed: %s", reg.Name, e.Error())
+		d.retryTransition(cs)
+		return
+	}
+	evs := []*Event{srvEvent(EventRemove, reg.Type, reg.Name, reg.Server, reg.Port)}
+	ptr := new(dns.PTR)
+	ptr.Hdr = dns.RR_Header{reg.Type, dns.TypePTR, dns.ClassINET, 0, 0}
+	ptr.Ptr = reg.Name
+	removed, e := d.removeUnreferenced(reg.Name, dns.TypeSRV, ptr)
+	if e == nil && removed {
+		evs = append(evs, ptrEvent(EventRemove, reg.Type, reg.Name))
+		_, e = d.removeUnreferenced(reg.Type, dns.TypePTR, d.metaPtr(reg.Type))
+	}
+	if e != nil {
+		logger.Error("Removing PTRs of withdrawn '%s' failed: %s", reg.Name, e.Error())
+	}
+	d.events.publish(evs...)
+}
+
+// Adds all records of the instance to DNS again.
+func (d *Director) reinstate(cs *checkState) {
+	_, rrs, e := d.newRegistration(cs.reg.Type, &cs.reg.DnsService)
+	if e == nil {
+		e = d.gate.Add(d.zone, rrs)
+	}
+	if e != nil {
+		logger.Error("Adding '%s' again failed: %s", cs.reg.Name, e.Error())
+		d.retryTransition(cs)
+		return
+	}
+	d.events.publish(ptrEvent(EventAdd, cs.reg.Type, cs.reg.Name), srvEvent(EventAdd, cs.reg.Type, cs.reg.Name, cs.reg.Server, cs.reg.Port))
+}
+
+// Rolls the state back, so the transition is made again after the next probe.
+func (d *Director) retryTransition(cs *checkState) {
+	d.health.lock.Lock()
+	defer d.health.lock.Unlock()
+	if cs.state == StateCritical {
+		cs.state = StateFailing
+	} else {
+		cs.state = StateCritical
+	}
+}
+
+func probe(reg *Registration, spec *checkSpec) error {
+	timeout := spec.interval
+	if timeout > maxCheckTimeout {
+		timeout = maxCheckTimeout
+	}
+	// the server name may resolve in the zone of the director only, so its address is probed if it is known
+	host := strings.TrimSuffix(reg.Server, ".")
+	if len(reg.Addresses) > 0 {
+		host = reg.Addresses[0]
+	}
+	address := net.JoinHostPort(host, strconv.FormatUint(uint64(reg.Port), 10))
+	switch spec.kind {
+	case CheckHttp:
+		client := &http.Client{Timeout: timeout}
+		resp, e := client.Get("http://" + address + reg.Params["path"])
+		if e != nil {
+			return e
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return NewDirectorError(ErrDirWrongCheck, "HTTP status %d", resp.StatusCode)
+		}
+		return nil
+	default:
+		conn, e := net.DialTimeout("tcp", address, timeout)
+		if e != nil {
+			return e
+		}
+		return conn.Close()
+	}
+}
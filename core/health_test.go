@@ -0,0 +1,232 @@
+package director
+
+import (
+	"git.reaxoft.loc/infomir/director/dnsgate"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]string
+		spec   *checkSpec
+		ok     bool
+	}{
+		{"not checked", map[string]string{"path": "/"}, nil, true},
+		{"defaults", map[string]string{CheckParam: CheckTcp}, &checkSpec{CheckTcp, defaultCheckInterval, defaultCheckThreshold}, true},
+		{"interval and threshold", map[string]string{CheckParam: CheckHttp, CheckIntervalParam: "5", CheckThresholdParam: "1"},
+			&checkSpec{CheckHttp, 5 * time.Second, 1}, true},
+		{"unknown kind", map[string]string{CheckParam: "icmp"}, nil, false},
+		{"zero interval", map[string]string{CheckParam: CheckTcp, CheckIntervalParam: "0"}, nil, false},
+		{"bad interval", map[string]string{CheckParam: CheckTcp, CheckIntervalParam: "5s"}, nil, false},
+		{"zero threshold", map[string]string{CheckParam: CheckTcp, CheckThresholdParam: "0"}, nil, false},
+		{"threshold too large", map[string]string{CheckParam: CheckTcp, CheckThresholdParam: "256"}, nil, false},
+	}
+	for _, tt := range tests {
+		spec, err := parseCheck(tt.params)
+		if !tt.ok {
+			if de, ok := err.(*DirectorError); !ok || de.Code != ErrDirWrongCheck {
+				t.Errorf("%s: want %s, got %v", tt.name, ErrDirWrongCheck, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if (spec == nil) != (tt.spec == nil) || spec != nil && *spec != *tt.spec {
+			t.Errorf("%s: %+v, want %+v", tt.name, spec, tt.spec)
+		}
+	}
+}
+
+// A gate whose changes fail while fail is set.
+type failingGate struct {
+	dnsgate.DnsGate
+	fail bool
+}
+
+func (g *failingGate) Add(zone string, rrs []dns.RR) error {
+	if g.fail {
+		return dnsgate.NewDnsError("", dnsgate.ErrDnsInternalError, "DNS server is down")
+	}
+	return g.DnsGate.Add(zone, rrs)
+}
+
+func (g *failingGate) Update(zone string, u *dnsgate.Update) error {
+	if g.fail {
+		return dnsgate.NewDnsError("", dnsgate.ErrDnsInternalError, "DNS server is down")
+	}
+	return g.DnsGate.Update(zone, u)
+}
+
+// A local TCP service which can be stopped and started again on the same port.
+type testService struct {
+	t    *testing.T
+	port uint16
+	l    net.Listener
+}
+
+func newTestService(t *testing.T) *testService {
+	s := &testService{t: t}
+	s.start("127.0.0.1:0")
+	s.port = uint16(s.l.Addr().(*net.TCPAddr).Port)
+	return s
+}
+
+func (s *testService) start(addr string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.l = l
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+}
+
+func (s *testService) up()   { s.start("127.0.0.1:" + strconv.Itoa(int(s.port))) }
+func (s *testService) down() { s.l.Close() }
+
+// Registers a checked instance of h1 at the service. The checks are made by the test, the
+// interval is too long for the checker to make any.
+func regChecked(t *testing.T, d *Director, name string, svc *testService) *checkState {
+	params := map[string]string{CheckParam: CheckTcp, CheckIntervalParam: "3600", CheckThresholdParam: "2"}
+	srv := &DnsService{Name: name, Server: "h1.cust.rxt.", Port: svc.port, Params: params, Addresses: []string{"127.0.0.1"}}
+	if _, err := d.RegDnsSrv("_bo._rest_http._tcp.cust.rxt.", srv); err != nil {
+		t.Fatal(err)
+	}
+	return d.health.checks[instanceKey(dotCanon(name), "h1.cust.rxt.", svc.port)]
+}
+
+// Returns the count of the records of the types at the name.
+func countRRs(t *testing.T, d *Director, typ uint16, name string) int {
+	rrs, err := d.gate.Query(typ, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(rrs)
+}
+
+func TestHealthWithdrawsAndReinstates(t *testing.T) {
+	const srvtype, name = "_bo._rest_http._tcp.cust.rxt.", "bo1._bo._rest_http._tcp.cust.rxt."
+	svc := newTestService(t)
+	defer svc.down()
+	d := newTestDirector()
+	defer d.Shutdown()
+	cs := regChecked(t, d, name, svc)
+
+	steps := []struct {
+		name  string
+		do    func()
+		state string
+		inDns bool
+	}{
+		{"passing", func() {}, StatePassing, true},
+		{"first failure", svc.down, StateFailing, true},
+		{"threshold reached", func() {}, StateCritical, false},
+		{"still failing", func() {}, StateCritical, false},
+		{"recovered", svc.up, StatePassing, true},
+	}
+	for _, s := range steps {
+		s.do()
+		d.check(cs)
+		srvs, err := d.FindDnsSrvInstances(name)
+		if err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+		if len(srvs) != 1 || srvs[0].State != s.state {
+			t.Fatalf("%s: instances %+v, want one %s", s.name, srvs, s.state)
+		}
+		records := map[string]int{
+			"SRV":          countRRs(t, d, dns.TypeSRV, name),
+			"instance TXT": countRRs(t, d, dns.TypeTXT, d.instOwner(name, "h1.cust.rxt.", svc.port)),
+			"A":            countRRs(t, d, dns.TypeA, "h1.cust.rxt."),
+			"name PTR":     countRRs(t, d, dns.TypePTR, srvtype),
+			"type PTR":     countRRs(t, d, dns.TypePTR, d.metaName()),
+		}
+		for rr, n := range records {
+			if (n == 1) != s.inDns {
+				t.Errorf("%s: %d %s, want in DNS %v", s.name, n, rr, s.inDns)
+			}
+		}
+		// the service keeps its params while its instance is withdrawn
+		if n := countRRs(t, d, dns.TypeTXT, name); n != 1 {
+			t.Errorf("%s: %d service TXTs, want 1", s.name, n)
+		}
+	}
+}
+
+func TestWithdrawKeepsSharedRecords(t *testing.T) {
+	const srvtype, name = "_bo._rest_http._tcp.cust.rxt.", "bo1._bo._rest_http._tcp.cust.rxt."
+	svc := newTestService(t)
+	d := newTestDirector()
+	defer d.Shutdown()
+	cs := regChecked(t, d, name, svc)
+	if _, err := d.RegDnsSrv(srvtype, &DnsService{Name: name, Server: "h1.cust.rxt.", Port: 9, Addresses: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	svc.down()
+	d.check(cs)
+	d.check(cs)
+	if cs.state != StateCritical {
+		t.Fatalf("state %s, want %s", cs.state, StateCritical)
+	}
+	records := []struct {
+		rr   string
+		typ  uint16
+		name string
+		n    int
+	}{
+		{"SRV of the other instance", dns.TypeSRV, name, 1},
+		{"shared address", dns.TypeA, "h1.cust.rxt.", 1},
+		{"name PTR", dns.TypePTR, srvtype, 1},
+		{"instance TXT", dns.TypeTXT, d.instOwner(name, "h1.cust.rxt.", svc.port), 0},
+	}
+	for _, r := range records {
+		if n := countRRs(t, d, r.typ, r.name); n != r.n {
+			t.Errorf("%s: %d, want %d", r.rr, n, r.n)
+		}
+	}
+}
+
+func TestTransitionRetriedAfterGateError(t *testing.T) {
+	const name = "bo1._bo._rest_http._tcp.cust.rxt."
+	svc := newTestService(t)
+	g := &failingGate{DnsGate: dnsgate.NewMemDnsGate()}
+	d := NewDirectorWithGate("cust.rxt", g)
+	defer d.Shutdown()
+	cs := regChecked(t, d, name, svc)
+
+	steps := []struct {
+		name  string
+		do    func()
+		state string
+		srvs  int
+	}{
+		{"first failure", func() { svc.down(); g.fail = true }, StateFailing, 1},
+		{"withdrawal fails", func() {}, StateFailing, 1},
+		{"withdrawn again", func() { g.fail = false }, StateCritical, 0},
+		{"reinstatement fails", func() { svc.up(); g.fail = true }, StateCritical, 0},
+		{"reinstated again", func() { g.fail = false }, StatePassing, 1},
+	}
+	for _, s := range steps {
+		s.do()
+		d.check(cs)
+		if cs.state != s.state {
+			t.Errorf("%s: state %s, want %s", s.name, cs.state, s.state)
+		}
+		if n := countRRs(t, d, dns.TypeSRV, name); n != s.srvs {
+			t.Errorf("%s: %d SRVs, want %d", s.name, n, s.srvs)
+		}
+	}
+	svc.down()
+}
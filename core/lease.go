@@ -0,0 +1,146 @@
+package director
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"git.reaxoft.loc/infomir/director/logger"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ErrDirLeaseNotFound = "director_lease_not_found"
+
+// The lease of a registered instance. The instance is removed from DNS unless the lease
+// is renewed within Ttl seconds.
+type Lease struct {
+	Id  string `json:"lease_id"`
+	Ttl uint32 `json:"lease_ttl"`
+}
+
+type leaseState struct {
+	Lease
+	name, server string
+	port         uint16
+	expires      time.Time
+}
+
+// Active leases by id and by instance.
+type leaseTable struct {
+	lock       sync.Mutex
+	byId       map[string]*leaseState
+	byInstance map[string]*leaseState
+}
+
+func newLeaseTable() *leaseTable {
+	return &leaseTable{byId: make(map[string]*leaseState), byInstance: make(map[string]*leaseState)}
+}
+
+func newLeaseId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Grants a lease to the instance, a previous lease of the instance is revoked.
+func (lt *leaseTable) grant(id string, ttl uint32, name, server string, port uint16) *Lease {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	lt.revokeLocked(instanceKey(name, server, port))
+	ls := &leaseState{Lease: Lease{Id: id, Ttl: ttl}, name: name, server: server, port: port}
+	ls.expires = time.Now().Add(time.Duration(ttl) * time.Second)
+	lt.byId[id] = ls
+	lt.byInstance[instanceKey(name, server, port)] = ls
+	return &ls.Lease
+}
+
+func (lt *leaseTable) renew(id string) (*Lease, error) {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	ls, ok := lt.byId[id]
+	if !ok {
+		return nil, NewDirectorError(ErrDirLeaseNotFound, "Lease '%s' not found or expired", id)
+	}
+	ls.expires = time.Now().Add(time.Duration(ls.Ttl) * time.Second)
+	return &ls.Lease, nil
+}
+
+func (lt *leaseTable) lookup(id string) (*leaseState, error) {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	ls, ok := lt.byId[id]
+	if !ok {
+		return nil, NewDirectorError(ErrDirLeaseNotFound, "Lease '%s' not found or expired", id)
+	}
+	return ls, nil
+}
+
+func (lt *leaseTable) revoke(name, server string, port uint16) {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	lt.revokeLocked(instanceKey(name, server, port))
+}
+
+func (lt *leaseTable) revokeLocked(key string) {
+	if ls, ok := lt.byInstance[key]; ok {
+		delete(lt.byInstance, key)
+		delete(lt.byId, ls.Id)
+	}
+}
+
+// Revokes leases of all instances of the service name.
+func (lt *leaseTable) revokeName(name string) {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	for key, ls := range lt.byInstance {
+		if strings.EqualFold(ls.name, name) {
+			lt.revokeLocked(key)
+		}
+	}
+}
+
+func (lt *leaseTable) expired(now time.Time) []*leaseState {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	var expired []*leaseState
+	for _, ls := range lt.byId {
+		if now.After(ls.expires) {
+			expired = append(expired, ls)
+		}
+	}
+	return expired
+}
+
+func (d *Director) RenewLease(id string) (*Lease, error) {
+	return d.leases.renew(id)
+}
+
+// Returns the service name and the server of the instance holding the lease.
+func (d *Director) LeaseInstance(id string) (string, string, error) {
+	ls, e := d.leases.lookup(id)
+	if e != nil {
+		return "", "", e
+	}
+	return ls.name, ls.server, nil
+}
+
+// Starts removing instances with expired leases every interval until Shutdown.
+func (d *Director) StartReaper(interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-d.done:
+				return
+			case now := <-t.C:
+				for _, ls := range d.leases.expired(now) {
+					logger.Info("Lease '%s' of '%s' at '%s:%d' expired", ls.Id, ls.name, ls.server, ls.port)
+					if e := d.RmInstance(ls.name, ls.server, ls.port); e != nil {
+						logger.Error("Removing instance with expired lease failed: %s", e.Error())
+					}
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,100 @@
+package director
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReaperRemovesExpiredInstances(t *testing.T) {
+	const srvtype, name = "_bo._rest_http._tcp.cust.rxt.", "bo1._bo._rest_http._tcp.cust.rxt."
+	d := newTestDirector()
+	defer d.Shutdown()
+	leases := make(map[string]*Lease)
+	for _, srv := range []*DnsService{
+		{Name: name, Server: "h1.cust.rxt.", Port: 80, LeaseTtl: 30},
+		{Name: name, Server: "h2.cust.rxt.", Port: 80, LeaseTtl: 30},
+		{Name: name, Server: "h3.cust.rxt.", Port: 80},
+	} {
+		lease, err := d.RegDnsSrv(srvtype, srv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (lease != nil) != (srv.LeaseTtl != 0) {
+			t.Fatalf("%s: lease %v for lease_ttl %d", srv.Server, lease, srv.LeaseTtl)
+		}
+		leases[srv.Server] = lease
+	}
+	ls, err := d.leases.lookup(leases["h1.cust.rxt."].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.leases.lock.Lock()
+	ls.expires = time.Now().Add(-time.Second)
+	d.leases.lock.Unlock()
+
+	d.StartReaper(10 * time.Millisecond)
+	var srvs []*DnsService
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if srvs, err = d.FindDnsSrvInstances(name); err != nil {
+			t.Fatal(err)
+		}
+		if len(srvs) == 2 {
+			break
+		}
+	}
+	servers := make(map[string]bool)
+	for _, srv := range srvs {
+		servers[srv.Server] = true
+	}
+	if len(srvs) != 2 || servers["h1.cust.rxt."] {
+		t.Fatalf("instances %v, want h2 and h3", servers)
+	}
+
+	tests := []struct {
+		server string
+		ok     bool
+	}{
+		{"h1.cust.rxt.", false},
+		{"h2.cust.rxt.", true},
+	}
+	for _, tt := range tests {
+		_, err := d.RenewLease(leases[tt.server].Id)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.server, err)
+		}
+		if de, ok := err.(*DirectorError); !tt.ok && (!ok || de.Code != ErrDirLeaseNotFound) {
+			t.Errorf("%s: want %s, got %v", tt.server, ErrDirLeaseNotFound, err)
+		}
+	}
+}
+
+func TestLeaseFollowsRegistration(t *testing.T) {
+	const srvtype, name = "_bo._rest_http._tcp.cust.rxt.", "bo1._bo._rest_http._tcp.cust.rxt."
+	d := newTestDirector()
+	first, err := d.RegDnsSrv(srvtype, &DnsService{Name: name, Server: "h1.cust.rxt.", Port: 80, LeaseTtl: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := d.RegDnsSrv(srvtype, &DnsService{Name: name, Server: "h1.cust.rxt.", Port: 80, LeaseTtl: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.RenewLease(first.Id); err == nil {
+		t.Error("the lease of the previous registration is renewed")
+	}
+	if srvname, server, err := d.LeaseInstance(second.Id); err != nil || srvname != name || server != "h1.cust.rxt." {
+		t.Errorf("instance of the lease is '%s' at '%s', %v", srvname, server, err)
+	}
+	if _, err := d.RegDnsSrv(srvtype, &DnsService{Name: name, Server: "h1.cust.rxt.", Port: 80}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.RenewLease(second.Id); err == nil {
+		t.Error("the lease is renewed after a registration without a lease")
+	}
+	if err := d.RmInstance(name, "h1.cust.rxt.", 80); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.leases.byId) != 0 || len(d.leases.byInstance) != 0 {
+		t.Errorf("leases are left after the instance is removed: %v", d.leases.byId)
+	}
+}
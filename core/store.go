@@ -0,0 +1,142 @@
+package director
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const ErrDirStoreError = "director_store_error"
+
+// A service instance registered through the director.
+type Registration struct {
+	Type    string `json:"type"`
+	LeaseId string `json:"lease_id,omitempty"`
+	DnsService
+
+	// TXT of the service name with the params of the instance, set by newRegistration
+	srvTxt *dns.TXT
+}
+
+func (r *Registration) key() string {
+	return instanceKey(r.Name, r.Server, r.Port)
+}
+
+func instanceKey(name, server string, port uint16) string {
+	return strings.ToLower(name) + "|" + strings.ToLower(server) + "|" + strconv.FormatUint(uint64(port), 10)
+}
+
+// The registrations made through the director. If path is not empty every change is written
+// to the file, so records lost by the DNS server can be pushed again after a restart.
+type registry struct {
+	lock sync.RWMutex
+	path string
+	regs map[string]*Registration
+}
+
+func newRegistry(path string) (*registry, error) {
+	r := &registry{path: path, regs: make(map[string]*Registration)}
+	if path == "" {
+		return r, nil
+	}
+	b, e := ioutil.ReadFile(path)
+	if os.IsNotExist(e) {
+		return r, nil
+	} else if e != nil {
+		return nil, NewDirectorError(ErrDirStoreError, "Can not read store '%s': %s", path, e.Error())
+	}
+	var regs []*Registration
+	if e := json.Unmarshal(b, &regs); e != nil {
+		return nil, NewDirectorError(ErrDirStoreError, "Can not parse store '%s': %s", path, e.Error())
+	}
+	for _, reg := range regs {
+		r.regs[reg.key()] = reg
+	}
+	return r, nil
+}
+
+// Writes all registrations to a temporary file and renames it over the store, so the store
+// is never left half written. Must be called with the write lock held.
+func (r *registry) flush() error {
+	if r.path == "" {
+		return nil
+	}
+	b, e := json.MarshalIndent(r.list(), "", "\t")
+	if e != nil {
+		return NewDirectorError(ErrDirStoreError, "Can not serialize store: %s", e.Error())
+	}
+	f, e := ioutil.TempFile(filepath.Dir(r.path), filepath.Base(r.path)+".")
+	if e != nil {
+		return NewDirectorError(ErrDirStoreError, "Can not write store: %s", e.Error())
+	}
+	if _, e = f.Write(b); e == nil {
+		e = f.Sync()
+	}
+	if ce := f.Close(); e == nil {
+		e = ce
+	}
+	if e == nil {
+		e = os.Rename(f.Name(), r.path)
+	}
+	if e != nil {
+		os.Remove(f.Name())
+		return NewDirectorError(ErrDirStoreError, "Can not write store: %s", e.Error())
+	}
+	return nil
+}
+
+// Returns registrations ordered by name. Must be called with a lock held.
+func (r *registry) list() []*Registration {
+	regs := make([]*Registration, 0, len(r.regs))
+	for _, reg := range r.regs {
+		regs = append(regs, reg)
+	}
+	sort.Slice(regs, func(i, j int) bool { return regs[i].key() < regs[j].key() })
+	return regs
+}
+
+func (r *registry) all() []*Registration {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.list()
+}
+
+func (r *registry) get(name, server string, port uint16) *Registration {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.regs[instanceKey(name, server, port)]
+}
+
+func (r *registry) put(regs ...*Registration) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, reg := range regs {
+		r.regs[reg.key()] = reg
+	}
+	return r.flush()
+}
+
+func (r *registry) removeInstance(name, server string, port uint16) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.regs, instanceKey(name, server, port))
+	return r.flush()
+}
+
+// Removes all instances of the service name.
+func (r *registry) removeName(name string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for k, reg := range r.regs {
+		if strings.EqualFold(reg.Name, name) {
+			delete(r.regs, k)
+		}
+	}
+	return r.flush()
+}
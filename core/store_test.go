@@ -0,0 +1,115 @@
+package director
+
+import (
+	"git.reaxoft.loc/infomir/director/dnsgate"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReconcilePushesStoredRegistrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.json")
+
+	const srvtype, name = "_bo._rest_http._tcp.cust.rxt.", "bo1._bo._rest_http._tcp.cust.rxt."
+	d := newTestDirector()
+	if err := d.OpenStore(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, server := range []string{"h1.cust.rxt.", "h2.cust.rxt.", "h3.cust.rxt."} {
+		srv := &DnsService{Name: name, Server: server, Port: 80, Params: map[string]string{"v": "1"}, Addresses: []string{"10.0.0.1"}}
+		if _, err := d.RegDnsSrv(srvtype, srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.RmInstance(name, "h3.cust.rxt.", 80); err != nil {
+		t.Fatal(err)
+	}
+
+	// the DNS server has lost all records, the store is read by the next director
+	d = NewDirectorWithGate("cust.rxt", dnsgate.NewMemDnsGate())
+	if err := d.OpenStore(path); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		name     string
+		repaired int
+	}{
+		{"records are lost", 2},
+		{"records are in place", 0},
+	}
+	for _, s := range steps {
+		repaired, err := d.Reconcile()
+		if err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+		if repaired != s.repaired {
+			t.Errorf("%s: %d repaired, want %d", s.name, repaired, s.repaired)
+		}
+		srvs, err := d.FindDnsSrvInstances(name)
+		if err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+		if len(srvs) != 2 {
+			t.Errorf("%s: %d instances, want 2", s.name, len(srvs))
+		}
+		if names, _ := d.FindDnsSrvNames(srvtype); len(names) != 1 {
+			t.Errorf("%s: names of the type %v, want %s", s.name, names, name)
+		}
+		if params := srvTxtParams(t, d, name); len(params) != 1 || params[0]["v"] != "1" {
+			t.Errorf("%s: service TXT %v, want one with v=1", s.name, params)
+		}
+	}
+}
+
+func TestStoreIsRewrittenOnChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.json")
+
+	const srvtype, name = "_bo._rest_http._tcp.cust.rxt.", "bo1._bo._rest_http._tcp.cust.rxt."
+	d := newTestDirector()
+	if err := d.OpenStore(path); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		name string
+		do   func() error
+		regs int
+	}{
+		{"register", func() error {
+			_, e := d.RegDnsSrv(srvtype, &DnsService{Name: name, Server: "h1.cust.rxt", Port: 80})
+			return e
+		}, 1},
+		{"register again", func() error {
+			_, e := d.RegDnsSrv(srvtype, &DnsService{Name: name, Server: "h1.cust.rxt", Port: 80, Weight: 5})
+			return e
+		}, 1},
+		{"register another", func() error {
+			_, e := d.RegDnsSrv(srvtype, &DnsService{Name: name, Server: "h2.cust.rxt", Port: 80})
+			return e
+		}, 2},
+		{"remove an instance", func() error { return d.RmInstance(name, "h1.cust.rxt", 80) }, 1},
+		{"remove the service", func() error { return d.RmDnsSrv(srvtype, name) }, 0},
+	}
+	for _, s := range steps {
+		if err := s.do(); err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+		r, err := newRegistry(path)
+		if err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+		if regs := r.all(); len(regs) != s.regs {
+			t.Errorf("%s: %d stored registrations, want %d", s.name, len(regs), s.regs)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package director
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+const ErrDirWatchExpired = "director_watch_expired"
+
+// Actions of events.
+const (
+	EventAdd    = "add"
+	EventRemove = "remove"
+)
+
+const maxEvents = 1024
+
+// A change of DNS records made by the director. Rr is "PTR" for an instance name attached to
+// or detached from the service type, "SRV" for an instance added to or removed from the name.
+// Type is empty for SRV events if the instance was not registered through the director.
+type Event struct {
+	Index  uint64 `json:"index"`
+	Action string `json:"action"`
+	Rr     string `json:"rr"`
+	Type   string `json:"type,omitempty"`
+	Name   string `json:"name"`
+	Server string `json:"server,omitempty"`
+	Port   uint16 `json:"port,omitempty"`
+}
+
+// The last maxEvents events, every event gets the next index. The index starts at 1, so the
+// index returned for index 0 is never 0 itself and a client always gets one to wait from.
+type eventLog struct {
+	lock   sync.Mutex
+	index  uint64
+	events []*Event
+	wake   chan struct{}
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{index: 1, wake: make(chan struct{})}
+}
+
+func (l *eventLog) publish(evs ...*Event) {
+	if len(evs) == 0 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, ev := range evs {
+		l.index++
+		ev.Index = l.index
+		l.events = append(l.events, ev)
+	}
+	if len(l.events) > maxEvents {
+		l.events = append([]*Event(nil), l.events[len(l.events)-maxEvents:]...)
+	}
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// Returns the matching events after index, the current index and a channel closed on the next publish.
+func (l *eventLog) since(index uint64, match func(*Event) bool) ([]*Event, uint64, <-chan struct{}, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if index > l.index || (index != 0 && len(l.events) > 0 && index+1 < l.events[0].Index) {
+		return nil, l.index, nil, NewDirectorError(ErrDirWatchExpired, "Events after index %d are not available, start over with index 0", index)
+	}
+	var evs []*Event
+	for _, ev := range l.events {
+		if ev.Index > index && match(ev) {
+			evs = append(evs, ev)
+		}
+	}
+	return evs, l.index, l.wake, nil
+}
+
+func ptrEvent(action, srvtype, srvname string) *Event {
+	return &Event{Action: action, Rr: "PTR", Type: srvtype, Name: srvname}
+}
+
+func srvEvent(action, srvtype, srvname, server string, port uint16) *Event {
+	return &Event{Action: action, Rr: "SRV", Type: srvtype, Name: srvname, Server: server, Port: port}
+}
+
+// Waits for events after index until ctx is done. Index 0 returns at once with the current index,
+// so a client lists the records and then watches for changes from that index. Returns the events
+// and the index to wait from next time.
+func (d *Director) watch(ctx context.Context, index uint64, match func(*Event) bool) ([]*Event, uint64, error) {
+	for {
+		evs, current, wake, err := d.events.since(index, match)
+		if err != nil || len(evs) > 0 || index == 0 {
+			return evs, current, err
+		}
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, current, nil
+		case <-d.done:
+			return nil, current, nil
+		}
+	}
+}
+
+// Waits for instance names attached to or detached from the service type.
+func (d *Director) WatchSrvType(ctx context.Context, srvtype string, index uint64) ([]*Event, uint64, error) {
+	csrvtype := dotCanon(srvtype)
+	if e := validateSrvType(strings.TrimSuffix(csrvtype, d.domain)); e != nil {
+		return nil, 0, e
+	}
+	return d.watch(ctx, index, func(ev *Event) bool {
+		return ev.Rr == "PTR" && strings.EqualFold(ev.Type, csrvtype)
+	})
+}
+
+// Waits for instances added to or removed from the service name.
+func (d *Director) WatchSrvName(ctx context.Context, srvname string, index uint64) ([]*Event, uint64, error) {
+	csrvname := dotCanon(srvname)
+	if e := validateSrvName(strings.TrimSuffix(csrvname, d.domain)); e != nil {
+		return nil, 0, e
+	}
+	return d.watch(ctx, index, func(ev *Event) bool {
+		return ev.Rr == "SRV" && strings.EqualFold(ev.Name, csrvname)
+	})
+}
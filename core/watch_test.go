@@ -0,0 +1,109 @@
+package director
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWatchEvents(t *testing.T) {
+	const srvtype, name = "_bo._rest_http._tcp.cust.rxt.", "bo1._bo._rest_http._tcp.cust.rxt."
+	d := newTestDirector()
+	_, index, err := d.WatchSrvName(context.Background(), name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a watch from the current index waits for the next change
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		d.RegDnsSrv(srvtype, &DnsService{Name: name, Server: "h1.cust.rxt.", Port: 80})
+	}()
+	evs, next, err := d.WatchSrvName(context.Background(), name, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evs) != 1 || evs[0].Action != EventAdd || evs[0].Rr != "SRV" || evs[0].Server != "h1.cust.rxt." || evs[0].Type != srvtype {
+		t.Fatalf("events %+v, want SRV add of h1", evs)
+	}
+	if next <= index {
+		t.Errorf("index %d is not after %d", next, index)
+	}
+
+	if err := d.RmInstance(name, "h1.cust.rxt.", 80); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		watch func(ctx context.Context, index uint64) ([]*Event, uint64, error)
+		index uint64
+		want  []string
+	}{
+		{"name", func(ctx context.Context, index uint64) ([]*Event, uint64, error) {
+			return d.WatchSrvName(ctx, name, index)
+		}, index, []string{"add SRV", "remove SRV"}},
+		{"name after the add", func(ctx context.Context, index uint64) ([]*Event, uint64, error) {
+			return d.WatchSrvName(ctx, name, index)
+		}, next, []string{"remove SRV"}},
+		{"type", func(ctx context.Context, index uint64) ([]*Event, uint64, error) {
+			return d.WatchSrvType(ctx, srvtype, index)
+		}, index, []string{"add PTR"}},
+		{"another name", func(ctx context.Context, index uint64) ([]*Event, uint64, error) {
+			return d.WatchSrvName(ctx, "bo2._bo._rest_http._tcp.cust.rxt.", index)
+		}, index, nil},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		evs, _, err := tt.watch(ctx, tt.index)
+		cancel()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, ev := range evs {
+			got = append(got, ev.Action+" "+ev.Rr)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: events %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: events %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestWatchExpiredIndex(t *testing.T) {
+	d := newTestDirector()
+	for i := 0; i < maxEvents+1; i++ {
+		d.events.publish(srvEvent(EventAdd, "", "bo1._bo._tcp.cust.rxt.", "h1.cust.rxt.", 80))
+	}
+	first := d.events.events[0].Index
+	tests := []struct {
+		index   uint64
+		expired bool
+	}{
+		{0, false},
+		// the events after the index are all kept
+		{first - 1, false},
+		{d.events.index, false},
+		// an event after the index has been dropped
+		{first - 2, true},
+		{d.events.index + 1, true},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, _, err := d.WatchSrvName(ctx, "bo1._bo._tcp.cust.rxt.", tt.index)
+		cancel()
+		if de, ok := err.(*DirectorError); tt.expired != (ok && de.Code == ErrDirWatchExpired) {
+			t.Errorf("index %d: %v, want expired %v", tt.index, err, tt.expired)
+		}
+	}
+	if _, _, err := d.WatchSrvName(context.Background(), "bo1._bo._tcp.cust.rxt.", 0); err != nil {
+		t.Error(err)
+	}
+}
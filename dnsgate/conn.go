@@ -0,0 +1,114 @@
+package dnsgate
+
+import (
+	"crypto/tls"
+	"git.reaxoft.loc/infomir/director/logger"
+	"github.com/miekg/dns"
+	"net"
+	"time"
+)
+
+// The connection to a DNS server over any of supported transports.
+type connGate struct {
+	conn    *dns.Conn
+	timeout time.Duration
+	err     error
+}
+
+// Dials a DNS server. A non nil tlsConf means DNS over TLS on top of the given stream network.
+func dialGate(network, address string, tlsConf *tls.Config, timeout time.Duration) (*connGate, error) {
+	dial := func() (*dns.Conn, error) {
+		if tlsConf != nil {
+			return dns.DialTimeoutWithTLS(network, address, tlsConf, timeout)
+		}
+		return dns.DialTimeout(network, address, timeout)
+	}
+	attempt := 1
+	for {
+		if co, err := dial(); err == nil {
+			return &connGate{conn: co, timeout: timeout}, nil
+		} else {
+			logger.Error("Attempt #%d to connect to '%s' DNS server failed: %s", attempt, address, err.Error())
+			if err, ok := err.(net.Error); ok {
+				switch {
+				case err.Timeout():
+					return nil, NewDnsError("", ErrDnsConnectionTimeout, "%s", err.Error())
+				case err.Temporary() && attempt < 3:
+					logger.Info("Detect temporary error. Try again.")
+					time.Sleep(10 * time.Millisecond)
+					attempt = attempt + 1
+				default:
+					return nil, NewDnsError("", ErrDnsConnectionError, "%s", err.Error())
+				}
+			} else {
+				return nil, NewDnsError("", ErrDnsInternalError, "%s", err.Error())
+			}
+		}
+	}
+}
+
+func (ug *connGate) deadline() time.Time {
+	return time.Now().Add(ug.timeout)
+}
+
+func (ug *connGate) setWriteDeadline() error {
+	if err := ug.conn.SetWriteDeadline(ug.deadline()); err != nil {
+		return NewDnsError("", ErrDnsInternalError, "%s", err.Error())
+	}
+	return nil
+}
+
+func (ug *connGate) setReadDeadline() error {
+	if err := ug.conn.SetReadDeadline(ug.deadline()); err != nil {
+		return NewDnsError("", ErrDnsInternalError, "%s", err.Error())
+	}
+	return nil
+}
+
+func (ug *connGate) write(msg []byte) (int, error) {
+	n, err := ug.conn.Write(msg)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return n, NewDnsError("", ErrDnsWriteTimeout, "%s", err.Error())
+	} else if err != nil {
+		return n, NewDnsError("", ErrDnsInternalError, "%s", err.Error())
+	}
+	return n, nil
+}
+
+func (ug *connGate) read() ([]byte, error) {
+	r, err := ug.conn.ReadMsgHeader(nil)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil, NewDnsError("", ErrDnsReadTimeout, "%s", err.Error())
+	} else if err != nil {
+		return nil, NewDnsError("", ErrDnsInternalError, "%s", err.Error())
+	}
+	return r, nil
+}
+
+func (ug *connGate) Release() error {
+	ug.err = ug.conn.Close()
+	return ug.err
+}
+
+func (ug *connGate) SendMessageSync(msg []byte) ([]byte, error) {
+	if ug.err = ug.setWriteDeadline(); ug.err != nil {
+		logger.Error("%s", ug.err.Error())
+		return nil, ug.err
+	}
+	if _, ug.err = ug.write(msg); ug.err != nil {
+		logger.Error("%s", ug.err.Error())
+		return nil, ug.err
+	}
+
+	if ug.err = ug.setReadDeadline(); ug.err != nil {
+		logger.Error("%s", ug.err.Error())
+		return nil, ug.err
+	}
+	var r []byte
+	if r, ug.err = ug.read(); ug.err != nil {
+		logger.Error("%s", ug.err.Error())
+		return nil, ug.err
+	}
+
+	return r, nil
+}
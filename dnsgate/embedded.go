@@ -0,0 +1,328 @@
+package dnsgate
+
+import (
+	"git.reaxoft.loc/infomir/director/logger"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The authoritative DNS server of a single zone. Records are kept in memory: changes made through
+// the DnsGate methods are applied locally, while UPDATE messages from the network are accepted only
+// if they are signed with the configured SIG(0) or TSIG key.
+type embeddedDnsGate struct {
+	*memDnsGate
+	zone string
+	ns   string
+
+	sig0 *dns.KEY
+	tsig *tsigSigner
+
+	// raw UPDATE messages by sender and message id, SIG(0) is verified over the original bytes
+	raws     map[string]rawMsg
+	rawsLock sync.Mutex
+
+	servers []*dns.Server
+}
+
+// Starts serving the zone on UDP and TCP at addr. The ns is the name server announced in the zone apex.
+// Keys in c are used to verify incoming updates, the transport settings are ignored.
+func NewEmbeddedDnsGate(zone, ns, addr string, c *Config) (DnsGate, error) {
+	g := &embeddedDnsGate{memDnsGate: newMemDnsGate(), zone: strings.ToLower(dns.Fqdn(zone)), ns: dns.Fqdn(ns), raws: make(map[string]rawMsg)}
+	if c.KeyPath != "" {
+		k, _, e := readDnsKey(c.KeyPath)
+		if e != nil {
+			return nil, e
+		}
+		g.sig0 = k
+	}
+	if c.TsigKeyPath != "" {
+		s, e := NewTsigSigner(c.TsigKeyPath)
+		if e != nil {
+			return nil, e
+		}
+		g.tsig = s.(*tsigSigner)
+	}
+	if g.sig0 == nil && g.tsig == nil {
+		logger.Warn("No DNS key is configured, UPDATE messages from the network will be refused")
+	}
+
+	pc, e := net.ListenPacket("udp", addr)
+	if e != nil {
+		return nil, NewDnsError("", ErrDnsListenError, "Can not listen on udp '%s': %s", addr, e.Error())
+	}
+	l, e := net.Listen("tcp", addr)
+	if e != nil {
+		pc.Close()
+		return nil, NewDnsError("", ErrDnsListenError, "Can not listen on tcp '%s': %s", addr, e.Error())
+	}
+	g.servers = []*dns.Server{g.newServer(), g.newServer()}
+	g.servers[0].PacketConn = pc
+	g.servers[1].Listener = l
+	for _, s := range g.servers {
+		go func(s *dns.Server) {
+			if e := s.ActivateAndServe(); e != nil {
+				logger.Error("Embedded DNS server failed: %s", e.Error())
+			}
+		}(s)
+	}
+	logger.Info("Embedded DNS server is authoritative for '%s' on %s", g.zone, addr)
+	return g, nil
+}
+
+func (g *embeddedDnsGate) newServer() *dns.Server {
+	// UDP updates of many records do not fit in the default buffer of 512 bytes
+	s := &dns.Server{Handler: g, MsgAcceptFunc: acceptQueryOrUpdate, UDPSize: dns.MaxMsgSize}
+	if g.tsig != nil {
+		s.TsigSecret = map[string]string{g.tsig.name: g.tsig.secret}
+	}
+	s.DecorateReader = func(r dns.Reader) dns.Reader {
+		return &rawKeeper{Reader: r, gate: g}
+	}
+	return s
+}
+
+// Unlike dns.DefaultMsgAcceptFunc lets updates with many RRs through.
+func acceptQueryOrUpdate(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Bits&(1<<15) != 0 {
+		return dns.MsgIgnore
+	}
+	opcode := int(dh.Bits>>11) & 0xF
+	if opcode != dns.OpcodeQuery && opcode != dns.OpcodeUpdate {
+		return dns.MsgRejectNotImplemented
+	}
+	if dh.Qdcount != 1 {
+		return dns.MsgReject
+	}
+	return dns.MsgAccept
+}
+
+// Raw messages not picked up by the handler in time, e.g. because they failed to unpack, are dropped.
+const (
+	maxRaws = 1024
+	rawTtl  = 10 * time.Second
+)
+
+type rawMsg struct {
+	b  []byte
+	at time.Time
+}
+
+// Tells whether the message is an UPDATE the server passes to the handler, and so worth keeping.
+func isUpdateMsg(b []byte) bool {
+	if len(b) < 12 {
+		return false
+	}
+	dh := dns.Header{
+		Bits:    uint16(b[2])<<8 | uint16(b[3]),
+		Qdcount: uint16(b[4])<<8 | uint16(b[5]),
+		Arcount: uint16(b[10])<<8 | uint16(b[11]),
+	}
+	// an UPDATE without additional records is not signed and needs no raw copy
+	return int(dh.Bits>>11)&0xF == dns.OpcodeUpdate && dh.Arcount > 0 && acceptQueryOrUpdate(dh) == dns.MsgAccept
+}
+
+func rawKey(addr net.Addr, b []byte) string {
+	return addr.String() + "#" + string(b[:2])
+}
+
+// Keeps a copy of the raw message, unless too many are waiting for the handler.
+func (g *embeddedDnsGate) keepRaw(addr net.Addr, b []byte) {
+	g.rawsLock.Lock()
+	defer g.rawsLock.Unlock()
+	now := time.Now()
+	if len(g.raws) >= maxRaws {
+		for k, raw := range g.raws {
+			if now.Sub(raw.at) > rawTtl {
+				delete(g.raws, k)
+			}
+		}
+		if len(g.raws) >= maxRaws {
+			logger.Warn("Too many UPDATE messages in flight, the one from %s can not be verified", addr.String())
+			return
+		}
+	}
+	g.raws[rawKey(addr, b)] = rawMsg{append([]byte(nil), b...), now}
+}
+
+// Returns and forgets the raw message, nil if it is not kept.
+func (g *embeddedDnsGate) takeRaw(key string) []byte {
+	g.rawsLock.Lock()
+	defer g.rawsLock.Unlock()
+	raw, ok := g.raws[key]
+	delete(g.raws, key)
+	if !ok || time.Since(raw.at) > rawTtl {
+		return nil
+	}
+	return raw.b
+}
+
+// Keeps raw UPDATE messages for the handler.
+type rawKeeper struct {
+	dns.Reader
+	gate *embeddedDnsGate
+}
+
+func (r *rawKeeper) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	b, e := r.Reader.ReadTCP(conn, timeout)
+	if e == nil && isUpdateMsg(b) {
+		r.gate.keepRaw(conn.RemoteAddr(), b)
+	}
+	return b, e
+}
+
+func (r *rawKeeper) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	b, s, e := r.Reader.ReadUDP(conn, timeout)
+	if e == nil && isUpdateMsg(b) {
+		r.gate.keepRaw(s.RemoteAddr(), b)
+	}
+	return b, s, e
+}
+
+func (g *embeddedDnsGate) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	switch r.Opcode {
+	case dns.OpcodeUpdate:
+		g.serveUpdate(w, r, m)
+	default:
+		g.serveQuery(r, m)
+	}
+
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		if int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		m.SetEdns0(uint16(size), false)
+	}
+	if _, ok := w.LocalAddr().(*net.UDPAddr); ok {
+		m.Truncate(size)
+	}
+	if e := w.WriteMsg(m); e != nil {
+		logger.Error("Writing DNS response failed: %s", e.Error())
+	}
+}
+
+func (g *embeddedDnsGate) soa() dns.RR {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	soa := new(dns.SOA)
+	soa.Hdr = dns.RR_Header{g.zone, dns.TypeSOA, dns.ClassINET, 60, 0}
+	soa.Ns = g.ns
+	soa.Mbox = "hostmaster." + g.zone
+	soa.Serial = g.serial
+	soa.Refresh = 3600
+	soa.Retry = 600
+	soa.Expire = 86400
+	soa.Minttl = 60
+	return soa
+}
+
+func (g *embeddedDnsGate) apex(typ uint16) []dns.RR {
+	var rrs []dns.RR
+	if typ == dns.TypeSOA || typ == dns.TypeANY {
+		rrs = append(rrs, g.soa())
+	}
+	if typ == dns.TypeNS || typ == dns.TypeANY {
+		ns := new(dns.NS)
+		ns.Hdr = dns.RR_Header{g.zone, dns.TypeNS, dns.ClassINET, 3600, 0}
+		ns.Ns = g.ns
+		rrs = append(rrs, ns)
+	}
+	return rrs
+}
+
+func (g *embeddedDnsGate) serveQuery(r *dns.Msg, m *dns.Msg) {
+	m.SetReply(r)
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	if !dns.IsSubDomain(g.zone, name) {
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+	m.Authoritative = true
+
+	m.Answer, _ = g.Query(q.Qtype, name)
+	if name == g.zone {
+		m.Answer = append(g.apex(q.Qtype), m.Answer...)
+	}
+	if len(m.Answer) == 0 {
+		if name != g.zone && !g.exists(name) {
+			m.Rcode = dns.RcodeNameError
+		}
+		m.Ns = []dns.RR{g.soa()}
+		return
+	}
+
+	// Save a round trip to DNS-SD clients: PTR targets come with their SRV and TXT, SRV targets with addresses.
+	for _, rr := range m.Answer {
+		switch t := rr.(type) {
+		case *dns.PTR:
+			extra, _ := g.Query(dns.TypeANY, t.Ptr)
+			m.Extra = append(m.Extra, extra...)
+		case *dns.SRV:
+			for _, typ := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				extra, _ := g.Query(typ, t.Target)
+				m.Extra = append(m.Extra, extra...)
+			}
+		}
+	}
+}
+
+func (g *embeddedDnsGate) serveUpdate(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	m.SetReply(r)
+	raw := g.takeRaw(rawKey(w.RemoteAddr(), []byte{byte(r.Id >> 8), byte(r.Id)}))
+
+	if r.Question[0].Qtype != dns.TypeSOA || strings.ToLower(r.Question[0].Name) != g.zone {
+		m.Rcode = dns.RcodeNotAuth
+		return
+	}
+
+	if t := r.IsTsig(); t != nil {
+		if g.tsig == nil || w.TsigStatus() != nil {
+			logger.Warn("Refused UPDATE from %s: bad TSIG '%s'", w.RemoteAddr().String(), t.Hdr.Name)
+			m.Rcode = dns.RcodeNotAuth
+			return
+		}
+		m.SetTsig(t.Hdr.Name, t.Algorithm, 300, time.Now().Unix())
+	} else if e := g.verifySig0(r, raw); e != nil {
+		logger.Warn("Refused UPDATE from %s: %s", w.RemoteAddr().String(), e.Error())
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+
+	m.Rcode = g.process(r)
+	logger.Debug("UPDATE from %s processed: %s", w.RemoteAddr().String(), dns.RcodeToString[m.Rcode])
+}
+
+func (g *embeddedDnsGate) verifySig0(r *dns.Msg, raw []byte) error {
+	if len(r.Extra) == 0 {
+		return NewDnsError(strconv.FormatUint(uint64(r.Id), 10), ErrDnsSigningError, "Update is not signed")
+	}
+	sig, ok := r.Extra[len(r.Extra)-1].(*dns.SIG)
+	if !ok {
+		return NewDnsError(strconv.FormatUint(uint64(r.Id), 10), ErrDnsSigningError, "Update is not signed")
+	}
+	if g.sig0 == nil || !strings.EqualFold(sig.SignerName, g.sig0.Hdr.Name) || sig.KeyTag != g.sig0.KeyTag() {
+		return NewDnsError(strconv.FormatUint(uint64(r.Id), 10), ErrDnsSigningError, "Unknown signer '%s'", sig.SignerName)
+	}
+	if raw == nil {
+		return NewDnsError(strconv.FormatUint(uint64(r.Id), 10), ErrDnsSigningError, "Raw message is lost")
+	}
+	if e := sig.Verify(g.sig0, raw); e != nil {
+		return NewDnsError(strconv.FormatUint(uint64(r.Id), 10), ErrDnsSigningError, "Bad signature: %s", e.Error())
+	}
+	return nil
+}
+
+// Stops the DNS servers.
+func (g *embeddedDnsGate) Shutdown() {
+	for _, s := range g.servers {
+		if e := s.Shutdown(); e != nil {
+			logger.Error("Embedded DNS server shutdown failed: %s", e.Error())
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package dnsgate
+
+import (
+	"github.com/miekg/dns"
+	"strconv"
+	"testing"
+)
+
+func TestEmbeddedUpdatesOverNetwork(t *testing.T) {
+	tsigKey, cleanupTsig := writeTsigKey(t)
+	defer cleanupTsig()
+	sig0Key, _, cleanupSig0 := writeSig0Key(t, dns.ECDSAP256SHA256, 256)
+	defer cleanupSig0()
+	port := freePort(t)
+	addr := "127.0.0.1:" + strconv.Itoa(int(port))
+
+	server, err := NewEmbeddedDnsGate("cust.rxt", "ns.cust.rxt", addr, &Config{KeyPath: sig0Key, TsigKeyPath: tsigKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.(*embeddedDnsGate).Shutdown()
+
+	tests := []struct {
+		net  string
+		conf *Config
+		ip   string
+	}{
+		{NetUdp, &Config{TsigKeyPath: tsigKey}, "10.0.0.1"},
+		{NetTcp, &Config{TsigKeyPath: tsigKey}, "10.0.0.2"},
+		{NetUdp, &Config{KeyPath: sig0Key}, "10.0.0.3"},
+		{NetTcp, &Config{KeyPath: sig0Key}, "10.0.0.4"},
+	}
+	for i, tt := range tests {
+		tt.conf.Net = tt.net
+		g, err := NewPooledDnsGate("127.0.0.1", port, tt.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := "h" + strconv.Itoa(i+1) + ".cust.rxt."
+		if err := g.Add("cust.rxt.", []dns.RR{testA(name, tt.ip)}); err != nil {
+			t.Errorf("%s %+v: signed update: %v", tt.net, tt.conf, err)
+			continue
+		}
+		rrs, err := g.Query(dns.TypeA, name)
+		if err != nil || len(rrs) != 1 || rrs[0].(*dns.A).A.String() != tt.ip {
+			t.Errorf("%s %+v: query after the update: %v %v", tt.net, tt.conf, rrs, err)
+		}
+	}
+
+	for _, network := range []string{NetUdp, NetTcp} {
+		m := new(dns.Msg)
+		m.SetUpdate("cust.rxt.")
+		m.Insert([]dns.RR{testA("unsigned.cust.rxt.", "10.0.0.9")})
+		c := &dns.Client{Net: network}
+		r, _, err := c.Exchange(m, addr)
+		if err != nil {
+			t.Fatalf("%s: %v", network, err)
+		}
+		if r.Rcode != dns.RcodeRefused {
+			t.Errorf("%s: unsigned update answered with %s, want REFUSED", network, dns.RcodeToString[r.Rcode])
+		}
+	}
+	if rrs, _ := server.Query(dns.TypeA, "unsigned.cust.rxt."); len(rrs) != 0 {
+		t.Errorf("unsigned update is applied: %v", rrs)
+	}
+}
@@ -0,0 +1,256 @@
+package dnsgate
+
+import (
+	"github.com/miekg/dns"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The in-memory DNS zone storage. Updates are processed as RFC 2136 (section 3.4.2) prescribes
+// for an authoritative server, so the gate behaves like a real one without any network.
+type memDnsGate struct {
+	lock   sync.RWMutex
+	rrs    map[string][]dns.RR
+	serial uint32
+}
+
+func NewMemDnsGate() DnsGate {
+	return newMemDnsGate()
+}
+
+func newMemDnsGate() *memDnsGate {
+	return &memDnsGate{rrs: make(map[string][]dns.RR), serial: 1}
+}
+
+func (g *memDnsGate) Add(zone string, srv []dns.RR) error {
+	return g.update(newAddMsg(zone, srv))
+}
+
+func (g *memDnsGate) Remove(zone string, name string, rrs []dns.RR) error {
+	return g.update(newRemoveMsg(zone, name, rrs))
+}
+
+func (g *memDnsGate) Update(zone string, u *Update) error {
+	return g.update(u.msg(zone))
+}
+
+func (g *memDnsGate) update(m *dns.Msg) error {
+	rcode := g.process(m)
+	if isPrereqRcode(rcode) {
+		return NewDnsError(strconv.FormatUint(uint64(m.Id), 10), ErrDnsPrereqFailed, "DNS update prerequisite is not met: '%s'", dns.RcodeToString[rcode])
+	}
+	if rcode != dns.RcodeSuccess {
+		return NewDnsError(strconv.FormatUint(uint64(m.Id), 10), ErrDnsUpdateFailed, "DNS update failed: '%s'", dns.RcodeToString[rcode])
+	}
+	return nil
+}
+
+// Applies the update message and returns the response code for it.
+func (g *memDnsGate) process(m *dns.Msg) int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	rcode := g.apply(m)
+	if rcode == dns.RcodeSuccess {
+		g.serial++
+	}
+	return rcode
+}
+
+// Applies the update section of the message if the prerequisites are met. The whole message is
+// checked before any change is made. Must be called with the write lock held.
+func (g *memDnsGate) apply(m *dns.Msg) int {
+	if len(m.Question) != 1 || m.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	zone := strings.ToLower(m.Question[0].Name)
+	if rcode := g.checkPrereqs(zone, m.Answer); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	for _, rr := range m.Ns {
+		h := rr.Header()
+		if !dns.IsSubDomain(zone, strings.ToLower(h.Name)) {
+			return dns.RcodeNotZone
+		}
+		switch h.Class {
+		case dns.ClassINET:
+			if h.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if h.Ttl != 0 || h.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if h.Ttl != 0 || h.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	for _, rr := range m.Ns {
+		h := rr.Header()
+		name := strings.ToLower(h.Name)
+		switch h.Class {
+		case dns.ClassINET:
+			g.insert(name, rr)
+		case dns.ClassANY:
+			if h.Rrtype == dns.TypeANY {
+				delete(g.rrs, name)
+			} else {
+				g.filter(name, func(x dns.RR) bool { return x.Header().Rrtype != h.Rrtype })
+			}
+		case dns.ClassNONE:
+			target := dns.Copy(rr)
+			target.Header().Class = dns.ClassINET
+			g.filter(name, func(x dns.RR) bool { return !dns.IsDuplicate(x, target) })
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// Checks the prerequisite section as RFC 2136 (section 3.2) prescribes. Must be called with a lock held.
+func (g *memDnsGate) checkPrereqs(zone string, prereqs []dns.RR) int {
+	// value dependent prerequisites by name and type
+	var valued []dns.RR
+	for _, rr := range prereqs {
+		h := rr.Header()
+		name := strings.ToLower(h.Name)
+		if h.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(zone, name) {
+			return dns.RcodeNotZone
+		}
+		switch h.Class {
+		case dns.ClassANY:
+			if h.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if h.Rrtype == dns.TypeANY {
+				if len(g.rrs[name]) == 0 {
+					return dns.RcodeNameError
+				}
+			} else if len(g.rrset(name, h.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if h.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if h.Rrtype == dns.TypeANY {
+				if len(g.rrs[name]) != 0 {
+					return dns.RcodeYXDomain
+				}
+			} else if len(g.rrset(name, h.Rrtype)) != 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			valued = append(valued, rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	for _, rr := range valued {
+		h := rr.Header()
+		var wanted []dns.RR
+		for _, w := range valued {
+			if w.Header().Rrtype == h.Rrtype && strings.EqualFold(w.Header().Name, h.Name) {
+				wanted = append(wanted, w)
+			}
+		}
+		present := g.rrset(strings.ToLower(h.Name), h.Rrtype)
+		if !sameRRs(present, wanted) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+func (g *memDnsGate) rrset(name string, typ uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range g.rrs[name] {
+		if rr.Header().Rrtype == typ {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// Reports whether both sets contain the same RRs ignoring TTLs and duplicates.
+func sameRRs(a, b []dns.RR) bool {
+	return containsRRs(a, b) && containsRRs(b, a)
+}
+
+func containsRRs(rrs, wanted []dns.RR) bool {
+	for _, w := range wanted {
+		found := false
+		for _, rr := range rrs {
+			if dns.IsDuplicate(rr, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *memDnsGate) insert(name string, rr dns.RR) {
+	for i, x := range g.rrs[name] {
+		if dns.IsDuplicate(x, rr) {
+			// An identical RR only refreshes the TTL.
+			g.rrs[name][i] = dns.Copy(rr)
+			return
+		}
+	}
+	g.rrs[name] = append(g.rrs[name], dns.Copy(rr))
+}
+
+// Keeps only the RRs of name for which keep returns true.
+func (g *memDnsGate) filter(name string, keep func(dns.RR) bool) {
+	var kept []dns.RR
+	for _, x := range g.rrs[name] {
+		if keep(x) {
+			kept = append(kept, x)
+		}
+	}
+	if len(kept) == 0 {
+		delete(g.rrs, name)
+	} else {
+		g.rrs[name] = kept
+	}
+}
+
+// Reports whether the name owns any RRs or is an empty non-terminal of an owner.
+func (g *memDnsGate) exists(name string) bool {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	name = strings.ToLower(name)
+	if _, ok := g.rrs[name]; ok {
+		return true
+	}
+	for owner := range g.rrs {
+		if strings.HasSuffix(owner, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *memDnsGate) Query(typ uint16, key string) ([]dns.RR, error) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	var rrs []dns.RR
+	for _, rr := range g.rrs[strings.ToLower(key)] {
+		if typ == dns.TypeANY || rr.Header().Rrtype == typ {
+			rrs = append(rrs, dns.Copy(rr))
+		}
+	}
+	return rrs, nil
+}
@@ -0,0 +1,54 @@
+package dnsgate
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func testTxt(name, txt string) dns.RR {
+	rr, _ := dns.NewRR(name + ` 60 IN TXT "` + txt + `"`)
+	return rr
+}
+
+func TestMemPrereqs(t *testing.T) {
+	tests := []struct {
+		name   string
+		prereq Prereq
+		ok     bool
+	}{
+		{"name used", NameUsed("h1.cust.rxt."), true},
+		{"name used, missing", NameUsed("h2.cust.rxt."), false},
+		{"name not used", NameNotUsed("h2.cust.rxt."), true},
+		{"name not used, present", NameNotUsed("H1.cust.rxt."), false},
+		{"rrset used", RRsetUsed("h1.cust.rxt.", dns.TypeTXT), true},
+		{"rrset used, missing", RRsetUsed("h1.cust.rxt.", dns.TypeAAAA), false},
+		{"rrset not used", RRsetNotUsed("h1.cust.rxt.", dns.TypeAAAA), true},
+		{"rrset not used, present", RRsetNotUsed("h1.cust.rxt.", dns.TypeA), false},
+		{"rrset equals", RRsetEquals([]dns.RR{testTxt("h1.cust.rxt.", "a"), testTxt("h1.cust.rxt.", "b")}), true},
+		{"rrset equals, one missing", RRsetEquals([]dns.RR{testTxt("h1.cust.rxt.", "a")}), false},
+		{"rrset equals, one more", RRsetEquals([]dns.RR{testTxt("h1.cust.rxt.", "a"), testTxt("h1.cust.rxt.", "b"),
+			testTxt("h1.cust.rxt.", "c")}), false},
+		{"rrset equals, another value", RRsetEquals([]dns.RR{testTxt("h1.cust.rxt.", "a"), testTxt("h1.cust.rxt.", "c")}), false},
+	}
+	for _, tt := range tests {
+		g := NewMemDnsGate()
+		if err := g.Add("cust.rxt.", []dns.RR{testA("h1.cust.rxt.", "10.0.0.1"), testTxt("h1.cust.rxt.", "a"),
+			testTxt("h1.cust.rxt.", "b")}); err != nil {
+			t.Fatal(err)
+		}
+		err := g.Update("cust.rxt.", &Update{Prereqs: []Prereq{tt.prereq}, RemoveNames: []string{"h1.cust.rxt."},
+			Insert: []dns.RR{testA("h3.cust.rxt.", "10.0.0.3")}})
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if de, ok := err.(*DnsError); !tt.ok && (!ok || de.Code != ErrDnsPrereqFailed) {
+			t.Errorf("%s: want %s, got %v", tt.name, ErrDnsPrereqFailed, err)
+		}
+		// the update is applied as a whole or not at all
+		h1, _ := g.Query(dns.TypeA, "h1.cust.rxt.")
+		h3, _ := g.Query(dns.TypeA, "h3.cust.rxt.")
+		if applied := len(h1) == 0 && len(h3) == 1; applied != tt.ok {
+			t.Errorf("%s: h1 %v, h3 %v, want applied %v", tt.name, h1, h3, tt.ok)
+		}
+	}
+}
@@ -1,15 +1,12 @@
 package dnsgate
 
 import (
-	"crypto"
-	"crypto/rsa"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"git.reaxoft.loc/infomir/director/logger"
 	"github.com/miekg/dns"
-	"os"
 	"strconv"
-	"strings"
 	"sync/atomic"
 	"time"
 )
@@ -21,11 +18,15 @@ const (
 	ErrDnsReadTimeout        = "dns_read_timeout"
 	ErrDnsInternalError      = "dns_internal_error"
 	ErrDnsWrongKeyPath       = "dns_wrong_key_path"
+	ErrDnsWrongCaPath        = "dns_wrong_ca_path"
+	ErrDnsWrongNet           = "dns_wrong_net"
 	ErrDnsSigningError       = "dns_signing_error"
 	ErrDnsBadResponseMessage = "dns_bad_response_message"
 	ErrDnsBadMessage         = "dns_bad_message"
 	ErrDnsUpdateFailed       = "dns_update_failed"
 	ErrDnsQueryFailed        = "dns_query_failed"
+	ErrDnsListenError        = "dns_listen_error"
+	ErrDnsPrereqFailed       = "dns_prereq_failed"
 )
 
 type DnsError struct {
@@ -54,6 +55,7 @@ func NewDnsError(msgId string, code string, msg string, a ...interface{}) *DnsEr
 type DnsGate interface {
 	Add(zone string, srv []dns.RR) error
 	Remove(zone string, name string, rrs []dns.RR) error
+	Update(zone string, u *Update) error
 	Query(typ uint16, key string) ([]dns.RR, error)
 }
 
@@ -65,196 +67,210 @@ const (
 	ReadTimeoutSec                     = 30 * time.Second
 )
 
-type pooledUdpDnsGate struct {
-	pool     chan *udpGate
+// Transports to reach a DNS server.
+const (
+	NetUdp = "udp"
+	NetTcp = "tcp"
+	NetTls = "tls"
+)
+
+// Returns the well-known DNS port of the transport.
+func DefaultPort(net string) uint16 {
+	if net == NetTls {
+		return 853
+	}
+	return 53
+}
+
+// Settings of a pooled gate. Updates are signed with the TSIG key from TsigKeyPath if it is set,
+// otherwise with the SIG(0) key from KeyPath. UdpSize is the EDNS0 buffer size advertised
+// in UDP queries, zero means dns.DefaultMsgSize.
+type Config struct {
+	Net         string
+	KeyPath     string
+	TsigKeyPath string
+	TlsConfig   *tls.Config
+	UdpSize     uint16
+}
+
+type pooledDnsGate struct {
+	pool     chan *connGate
 	poolSize uint32
 
 	domain  string
 	port    uint16
-	key     *dns.KEY
-	privkey crypto.PrivateKey
-}
+	net     string
+	tlsConf *tls.Config
+	udpSize uint16
+	signer  Signer
 
-func NewPooledUdpDnsGate(d string, p uint16, privkeyPath string) (DnsGate, error) {
-	k, pk, e := readDnsKey(privkeyPath)
-	if e != nil {
-		return nil, e
-	}
-	return &pooledUdpDnsGate{domain: d, port: p, key: k, privkey: pk, pool: make(chan *udpGate, poolMaxSize)}, nil
+	// TCP gate to repeat truncated UDP queries with
+	fallback *pooledDnsGate
 }
 
-func readDnsKey(privkeyPath string) (*dns.KEY, crypto.PrivateKey, error) {
-	if !strings.HasSuffix(privkeyPath, ".private") {
-		return nil, nil, NewDnsError("", ErrDnsWrongKeyPath, "Path: '%s'", privkeyPath)
+func NewPooledDnsGate(d string, p uint16, c *Config) (DnsGate, error) {
+	switch c.Net {
+	case NetUdp, NetTcp, NetTls:
+	default:
+		return nil, NewDnsError("", ErrDnsWrongNet, "Unsupported DNS transport '%s'", c.Net)
 	}
-
-	var dir string
-	var privkeyFile string
-	if idx := strings.LastIndex(privkeyPath, "/"); idx == -1 {
-		dir = ""
-		privkeyFile = privkeyPath
+	var signer Signer
+	var e error
+	if c.TsigKeyPath != "" {
+		signer, e = NewTsigSigner(c.TsigKeyPath)
 	} else {
-		dir = privkeyPath[:idx+1]
-		privkeyFile = privkeyPath[idx+1:]
+		signer, e = NewSig0Signer(c.KeyPath)
 	}
-	pubkeyFile := strings.TrimSuffix(privkeyFile, "private") + "key"
-
-	pubf, e := os.Open(dir + pubkeyFile)
 	if e != nil {
-		return nil, nil, NewDnsError("", ErrDnsWrongKeyPath, "Can not open public key file: '%s'", e.Error())
+		return nil, e
 	}
-	pubkey, e := dns.ReadRR(pubf, pubkeyFile)
-	if e != nil {
-		return nil, nil, NewDnsError("", ErrDnsWrongKeyPath, "Can not parse public key: '%s'", e.Error())
+	g := &pooledDnsGate{domain: d, port: p, net: c.Net, tlsConf: c.TlsConfig, signer: signer, pool: make(chan *connGate, poolMaxSize)}
+	if c.Net == NetUdp {
+		g.udpSize = c.UdpSize
+		if g.udpSize == 0 {
+			g.udpSize = dns.DefaultMsgSize
+		}
+		g.fallback = &pooledDnsGate{domain: d, port: p, net: NetTcp, signer: signer, pool: make(chan *connGate, poolMaxSize)}
 	}
+	return g, nil
+}
 
-	privf, e := os.Open(privkeyPath)
-	if e != nil {
-		return nil, nil, NewDnsError("", ErrDnsWrongKeyPath, "Can not open private key file: '%s'", e.Error())
-	}
-	key := pubkey.(*dns.KEY)
-	privkey, e := key.ReadPrivateKey(privf, privkeyFile)
-	if e != nil {
-		return nil, nil, NewDnsError("", ErrDnsWrongKeyPath, "Can not parse private key file: '%s'", e.Error())
+func NewPooledUdpDnsGate(d string, p uint16, privkeyPath string) (DnsGate, error) {
+	return NewPooledDnsGate(d, p, &Config{Net: NetUdp, KeyPath: privkeyPath})
+}
+
+func NewPooledTcpDnsGate(d string, p uint16, privkeyPath string) (DnsGate, error) {
+	return NewPooledDnsGate(d, p, &Config{Net: NetTcp, KeyPath: privkeyPath})
+}
+
+func NewPooledTlsDnsGate(d string, p uint16, privkeyPath string, conf *tls.Config) (DnsGate, error) {
+	return NewPooledDnsGate(d, p, &Config{Net: NetTls, KeyPath: privkeyPath, TlsConfig: conf})
+}
+
+func (p *pooledDnsGate) dial() (*connGate, error) {
+	address := p.domain + ":" + strconv.FormatUint(uint64(p.port), 10)
+	switch p.net {
+	case NetTcp:
+		return NewTcpGate(address, ConnectionTimeoutSec)
+	case NetTls:
+		return NewTlsGate(address, p.tlsConf, ConnectionTimeoutSec)
+	default:
+		g, e := NewUdpGate(address, ConnectionTimeoutSec)
+		if e != nil {
+			return nil, e
+		}
+		g.conn.UDPSize = p.udpSize
+		return g, nil
 	}
-	return key, privkey, nil
 }
 
-func (p *pooledUdpDnsGate) acquire() (g *udpGate, err error) {
+// Returns a pooled connection, or a new one while the pool is not full. reused tells the
+// connection comes from the pool.
+func (p *pooledDnsGate) acquire() (g *connGate, reused bool, err error) {
 	select {
 	case con := <-p.pool:
-		return con, nil
+		return con, true, nil
 	default:
 		if atomic.LoadUint32(&p.poolSize) >= poolMaxSize {
 			con := <-p.pool
-			return con, nil
-		} else {
-			if atomic.AddUint32(&p.poolSize, 1) > poolMaxSize {
-				atomic.AddUint32(&p.poolSize, ^uint32(0))
-				con := <-p.pool
-				return con, nil
-			} else {
-				defer func() {
-					if r := recover(); r != nil {
-						atomic.AddUint32(&p.poolSize, ^uint32(0))
-						err = NewDnsError("", ErrDnsConnectionError, "Error while connection: %v", r)
-						g = nil
-					}
-				}()
-				con, e := NewUdpGate(p.domain+":"+strconv.FormatUint(uint64(p.port), 10), ConnectionTimeoutSec)
-				if e != nil {
-					atomic.AddUint32(&p.poolSize, ^uint32(0))
-					return nil, e
-				}
-				return con, nil
-			}
+			return con, true, nil
 		}
-	}
-	return nil, nil
-}
-
-func (p *pooledUdpDnsGate) release(g *udpGate) {
-	if g.err != nil {
-		atomic.AddUint32(&p.poolSize, ^uint32(0))
-		g.Release()
-	} else {
-		select {
-		case p.pool <- g:
-			return
-		default:
+		if atomic.AddUint32(&p.poolSize, 1) > poolMaxSize {
 			atomic.AddUint32(&p.poolSize, ^uint32(0))
-			g.Release()
+			con := <-p.pool
+			return con, true, nil
 		}
+		g, err = p.open()
+		return g, false, err
 	}
 }
 
-func (p *pooledUdpDnsGate) Add(zone string, srv []dns.RR) error {
-	m := new(dns.Msg)
-	m.SetUpdate(zone)
-	m.Insert(srv)
-
-	now := uint32(time.Now().Unix())
-	sig := new(dns.SIG)
-	sig.Hdr.Name = "."
-	sig.Hdr.Rrtype = dns.TypeSIG
-	sig.Hdr.Class = dns.ClassANY
-	sig.Algorithm = p.key.Algorithm
-	sig.SignerName = p.key.Hdr.Name
-	sig.Expiration = now + 300
-	sig.Inception = now - 300
-	sig.KeyTag = p.key.KeyTag()
-
-	mb, e := sig.Sign(p.privkey.(*rsa.PrivateKey), m)
+// Dials a connection already counted in the pool size.
+func (p *pooledDnsGate) open() (g *connGate, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint32(&p.poolSize, ^uint32(0))
+			err = NewDnsError("", ErrDnsConnectionError, "Error while connection: %v", r)
+			g = nil
+		}
+	}()
+	con, e := p.dial()
 	if e != nil {
-		logger.Error("Signing error: %s", e.Error())
-		return NewDnsError(strconv.FormatUint(uint64(m.Id), 10), ErrDnsSigningError, "Signing error: %s", e.Error())
+		atomic.AddUint32(&p.poolSize, ^uint32(0))
+		return nil, e
 	}
+	return con, nil
+}
 
-	g, e := p.acquire()
+// Sends the message and returns the response. The server may have closed a pooled connection
+// while it was idle, so the message is sent once more over a new connection if a reused one fails.
+// Timeouts are not retried, the server may have got the message.
+func (p *pooledDnsGate) exchange(mb []byte) ([]byte, error) {
+	g, reused, e := p.acquire()
 	if e != nil {
 		logger.Error("Getting connection error: %s", e.Error())
-		return e
+		return nil, e
 	}
-	defer p.release(g)
-
 	rb, e := g.SendMessageSync(mb)
-	if e != nil {
-		logger.Error("Sending message to DNS Server error: %s", e.Error())
-		return e
+	p.release(g)
+	if de, ok := e.(*DnsError); !reused || !ok || de.Code != ErrDnsInternalError {
+		return rb, e
 	}
 
-	r := new(dns.Msg)
-	if err := r.Unpack(rb); err != nil {
-		logger.Error("Unpacking DNS response message error: %s", e.Error())
-		return NewDnsError(strconv.FormatUint(uint64(m.Id), 10), ErrDnsBadResponseMessage, "Bad response message: '%s'", err.Error())
+	logger.Debug("Pooled connection to DNS server failed, sending again over a new one")
+	atomic.AddUint32(&p.poolSize, 1)
+	if g, e = p.open(); e != nil {
+		logger.Error("Getting connection error: %s", e.Error())
+		return nil, e
 	}
+	defer p.release(g)
+	return g.SendMessageSync(mb)
+}
 
-	if r != nil && r.Rcode != dns.RcodeSuccess {
-		logger.Error("DNS update failed: %s", r.String())
-		return NewDnsError(strconv.FormatUint(uint64(m.Id), 10), ErrDnsUpdateFailed, "DNS update failed: '%v'", r)
+func (p *pooledDnsGate) release(g *connGate) {
+	if g.err != nil {
+		atomic.AddUint32(&p.poolSize, ^uint32(0))
+		g.Release()
+	} else {
+		select {
+		case p.pool <- g:
+			return
+		default:
+			atomic.AddUint32(&p.poolSize, ^uint32(0))
+			g.Release()
+		}
 	}
-	return nil
 }
 
-func (p *pooledUdpDnsGate) Remove(zone string, name string, rrs []dns.RR) error {
-	m := new(dns.Msg)
-	m.SetUpdate(zone)
+func (p *pooledDnsGate) Add(zone string, srv []dns.RR) error {
+	return p.update(newAddMsg(zone, srv))
+}
 
-	if len(rrs) > 0 {
-		m.Remove(rrs)
-	}
+func (p *pooledDnsGate) Remove(zone string, name string, rrs []dns.RR) error {
+	return p.update(newRemoveMsg(zone, name, rrs))
+}
 
-	if name != "" {
-		any := new(dns.ANY)
-		any.Hdr = dns.RR_Header{name, dns.TypeANY, dns.ClassINET, 0, 0}
-		m.RemoveName([]dns.RR{any})
-	}
+func (p *pooledDnsGate) Update(zone string, u *Update) error {
+	return p.update(u.msg(zone))
+}
 
-	now := uint32(time.Now().Unix())
-	sig := new(dns.SIG)
-	sig.Hdr.Name = "."
-	sig.Hdr.Rrtype = dns.TypeSIG
-	sig.Hdr.Class = dns.ClassANY
-	sig.Algorithm = p.key.Algorithm
-	sig.SignerName = p.key.Hdr.Name
-	sig.Expiration = now + 300
-	sig.Inception = now - 300
-	sig.KeyTag = p.key.KeyTag()
-
-	mb, e := sig.Sign(p.privkey.(*rsa.PrivateKey), m)
+// Signs and sends the update message, then checks the response code.
+func (p *pooledDnsGate) update(m *dns.Msg) error {
+	var mb []byte
+	var mac string
+	var e error
+	vs, verify := p.signer.(verifyingSigner)
+	if verify {
+		mb, mac, e = vs.signRequest(m)
+	} else {
+		mb, e = p.signer.Sign(m)
+	}
 	if e != nil {
 		logger.Error("Signing error: %s", e.Error())
 		return NewDnsError(strconv.FormatUint(uint64(m.Id), 10), ErrDnsSigningError, "Signing error: %s", e.Error())
 	}
 
-	g, e := p.acquire()
-	if e != nil {
-		logger.Error("Getting connection error: %s", e.Error())
-		return e
-	}
-	defer p.release(g)
-
-	rb, e := g.SendMessageSync(mb)
+	rb, e := p.exchange(mb)
 	if e != nil {
 		logger.Error("Sending message to DNS Server error: %s", e.Error())
 		return e
@@ -262,10 +278,20 @@ func (p *pooledUdpDnsGate) Remove(zone string, name string, rrs []dns.RR) error
 
 	r := new(dns.Msg)
 	if err := r.Unpack(rb); err != nil {
-		logger.Error("Unpacking DNS response message error: %s", e.Error())
+		logger.Error("Unpacking DNS response message error: %s", err.Error())
 		return NewDnsError(strconv.FormatUint(uint64(m.Id), 10), ErrDnsBadResponseMessage, "Bad response message: '%s'", err.Error())
 	}
+	if verify {
+		if err := vs.verifyResponse(rb, mac); err != nil {
+			logger.Error("DNS response to update is not signed with the key: %s", err.Error())
+			return NewDnsError(strconv.FormatUint(uint64(m.Id), 10), ErrDnsSigningError, "Response with rcode '%s' is not signed with the key: %s", dns.RcodeToString[r.Rcode], err.Error())
+		}
+	}
 
+	if isPrereqRcode(r.Rcode) {
+		logger.Debug("DNS update prerequisite is not met: %s", dns.RcodeToString[r.Rcode])
+		return NewDnsError(strconv.FormatUint(uint64(m.Id), 10), ErrDnsPrereqFailed, "DNS update prerequisite is not met: '%s'", dns.RcodeToString[r.Rcode])
+	}
 	if r != nil && r.Rcode != dns.RcodeSuccess {
 		logger.Error("DNS update failed: %s", r.String())
 		return NewDnsError(strconv.FormatUint(uint64(m.Id), 10), ErrDnsUpdateFailed, "DNS update failed: '%v'", r)
@@ -273,22 +299,19 @@ func (p *pooledUdpDnsGate) Remove(zone string, name string, rrs []dns.RR) error
 	return nil
 }
 
-func (p *pooledUdpDnsGate) Query(typ uint16, key string) ([]dns.RR, error) {
+func (p *pooledDnsGate) Query(typ uint16, key string) ([]dns.RR, error) {
 	m := new(dns.Msg)
 	m.SetQuestion(key, typ)
-
-	g, e := p.acquire()
-	if e != nil {
-		return nil, e
+	if p.net == NetUdp && p.udpSize > dns.MinMsgSize {
+		m.SetEdns0(p.udpSize, false)
 	}
-	defer p.release(g)
 
 	mb, e := m.Pack()
 	if e != nil {
 		return nil, NewDnsError(strconv.FormatUint(uint64(m.Id), 10), ErrDnsBadMessage, "Bad message: '%s'", e.Error())
 	}
 
-	rb, e := g.SendMessageSync(mb)
+	rb, e := p.exchange(mb)
 	if e != nil {
 		return nil, e
 	}
@@ -298,6 +321,11 @@ func (p *pooledUdpDnsGate) Query(typ uint16, key string) ([]dns.RR, error) {
 		return nil, NewDnsError(strconv.FormatUint(uint64(m.Id), 10), ErrDnsBadResponseMessage, "Bad response message: '%s'", err.Error())
 	}
 
+	if r.Truncated && p.fallback != nil {
+		logger.Debug("Response to '%s' query is truncated, retrying over TCP", key)
+		return p.fallback.Query(typ, key)
+	}
+
 	if r == nil || r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
 		logger.Debug("rcode: %d", r.Rcode)
 		return nil, NewDnsError(strconv.FormatUint(uint64(m.Id), 10), ErrDnsUpdateFailed, "DNS query failed: '%v'", r)
@@ -0,0 +1,137 @@
+package dnsgate
+
+import (
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+const testTsigKey = `key "director.cust.rxt" {
+	algorithm hmac-sha256;
+	secret "c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0LXNlY3JldA==";
+};
+`
+
+// Writes the TSIG key file into a temporary directory, the returned func removes it.
+func writeTsigKey(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "dnsgate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "director.tsig")
+	if err := ioutil.WriteFile(path, []byte(testTsigKey), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+// Returns a local port free for both UDP and TCP.
+func freePort(t *testing.T) uint16 {
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		if pc, err := net.ListenPacket("udp", "127.0.0.1:"+strconv.Itoa(port)); err == nil {
+			pc.Close()
+			return uint16(port)
+		}
+	}
+	t.Fatal("no free port")
+	return 0
+}
+
+func testA(name, ip string) dns.RR {
+	rr, _ := dns.NewRR(name + " 60 IN A " + ip)
+	return rr
+}
+
+func TestPooledConnectionClosedByServer(t *testing.T) {
+	key, cleanup := writeTsigKey(t)
+	defer cleanup()
+	port := freePort(t)
+	addr := "127.0.0.1:" + strconv.Itoa(int(port))
+
+	for _, network := range []string{NetTcp, NetUdp} {
+		server, err := NewEmbeddedDnsGate("cust.rxt", "ns.cust.rxt", addr, &Config{TsigKeyPath: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := NewPooledDnsGate("127.0.0.1", port, &Config{Net: network, TsigKeyPath: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Add("cust.rxt.", []dns.RR{testA("h1.cust.rxt.", "10.0.0.1")}); err != nil {
+			t.Fatalf("%s: %v", network, err)
+		}
+
+		// the pooled connection is closed by the restarted server
+		server.(*embeddedDnsGate).Shutdown()
+		server, err = NewEmbeddedDnsGate("cust.rxt", "ns.cust.rxt", addr, &Config{TsigKeyPath: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Add("cust.rxt.", []dns.RR{testA("h2.cust.rxt.", "10.0.0.2")}); err != nil {
+			t.Errorf("%s: update over a closed pooled connection: %v", network, err)
+		}
+		if rrs, err := g.Query(dns.TypeA, "h2.cust.rxt."); err != nil || len(rrs) != 1 {
+			t.Errorf("%s: query after the restart: %v %v", network, rrs, err)
+		}
+		server.(*embeddedDnsGate).Shutdown()
+	}
+}
+
+func TestTruncatedQueryRetriedOverTcp(t *testing.T) {
+	key, cleanup := writeTsigKey(t)
+	defer cleanup()
+	port := freePort(t)
+	addr := "127.0.0.1:" + strconv.Itoa(int(port))
+
+	var answer []dns.RR
+	for i := 1; i <= 20; i++ {
+		answer = append(answer, testA("h1.cust.rxt.", "10.0.0."+strconv.Itoa(i)))
+	}
+	// over UDP only the header comes back with the TC bit, over TCP the full answer
+	respond := func(truncate bool) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if truncate {
+				m.Truncated = true
+			} else {
+				m.Answer = answer
+			}
+			w.WriteMsg(m)
+		}
+	}
+	servers := []*dns.Server{
+		{Addr: addr, Net: "udp", Handler: respond(true)},
+		{Addr: addr, Net: "tcp", Handler: respond(false)},
+	}
+	for _, s := range servers {
+		started := make(chan struct{})
+		s.NotifyStartedFunc = func() { close(started) }
+		go s.ListenAndServe()
+		<-started
+		defer s.Shutdown()
+	}
+
+	g, err := NewPooledDnsGate("127.0.0.1", port, &Config{Net: NetUdp, TsigKeyPath: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrs, err := g.Query(dns.TypeA, "h1.cust.rxt.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != len(answer) {
+		t.Errorf("%d records in the answer, want %d", len(rrs), len(answer))
+	}
+}
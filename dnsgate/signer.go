@@ -0,0 +1,141 @@
+package dnsgate
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"github.com/miekg/dns"
+	"os"
+	"strings"
+	"time"
+)
+
+// Signer authenticates update messages sent to a DNS server.
+type Signer interface {
+	// Signs the message and returns it in the wire format.
+	Sign(m *dns.Msg) ([]byte, error)
+}
+
+// A signer whose responses are signed as well.
+type verifyingSigner interface {
+	Signer
+	// Signs the message like Sign and returns the MAC to verify the response with.
+	signRequest(m *dns.Msg) ([]byte, string, error)
+	verifyResponse(rb []byte, requestMac string) error
+}
+
+// Signs messages with a SIG(0) transaction signature (RFC 2931).
+type sig0Signer struct {
+	key     *dns.KEY
+	privkey crypto.Signer
+}
+
+// Algorithms of SIG(0) keys which can be used for signing.
+var sig0Algorithms = map[uint8]bool{
+	dns.RSASHA1:          true,
+	dns.RSASHA1NSEC3SHA1: true,
+	dns.RSASHA256:        true,
+	dns.RSASHA512:        true,
+	dns.ECDSAP256SHA256:  true,
+	dns.ECDSAP384SHA384:  true,
+	dns.ED25519:          true,
+}
+
+// Creates a SIG(0) signer from a pair of BIND key files. The public key is expected
+// next to the private one with the '.key' extension.
+func NewSig0Signer(privkeyPath string) (Signer, error) {
+	k, pk, e := readDnsKey(privkeyPath)
+	if e != nil {
+		return nil, e
+	}
+	signer, e := asSig0Signer(k, pk)
+	if e != nil {
+		return nil, e
+	}
+
+	// Sign a probe message to find a broken key at startup rather than on the first update.
+	m := new(dns.Msg)
+	m.SetUpdate(k.Hdr.Name)
+	if _, e := signer.Sign(m); e != nil {
+		return nil, NewDnsError("", ErrDnsSigningError, "Can not sign with key '%s': %s", privkeyPath, e.Error())
+	}
+	return signer, nil
+}
+
+// Checks the private key matches the algorithm of the public one.
+func asSig0Signer(key *dns.KEY, privkey crypto.PrivateKey) (*sig0Signer, error) {
+	if !sig0Algorithms[key.Algorithm] {
+		return nil, NewDnsError("", ErrDnsWrongKeyPath, "Unsupported key algorithm '%s'", dns.AlgorithmToString[key.Algorithm])
+	}
+	var ok bool
+	switch key.Algorithm {
+	case dns.ECDSAP256SHA256, dns.ECDSAP384SHA384:
+		_, ok = privkey.(*ecdsa.PrivateKey)
+	case dns.ED25519:
+		_, ok = privkey.(ed25519.PrivateKey)
+	default:
+		_, ok = privkey.(*rsa.PrivateKey)
+	}
+	if !ok {
+		return nil, NewDnsError("", ErrDnsSigningError, "Private key of type %T does not match '%s' algorithm", privkey, dns.AlgorithmToString[key.Algorithm])
+	}
+	return &sig0Signer{key: key, privkey: privkey.(crypto.Signer)}, nil
+}
+
+func readDnsKey(privkeyPath string) (*dns.KEY, crypto.PrivateKey, error) {
+	if !strings.HasSuffix(privkeyPath, ".private") {
+		return nil, nil, NewDnsError("", ErrDnsWrongKeyPath, "Path: '%s'", privkeyPath)
+	}
+
+	var dir string
+	var privkeyFile string
+	if idx := strings.LastIndex(privkeyPath, "/"); idx == -1 {
+		dir = ""
+		privkeyFile = privkeyPath
+	} else {
+		dir = privkeyPath[:idx+1]
+		privkeyFile = privkeyPath[idx+1:]
+	}
+	pubkeyFile := strings.TrimSuffix(privkeyFile, "private") + "key"
+
+	pubf, e := os.Open(dir + pubkeyFile)
+	if e != nil {
+		return nil, nil, NewDnsError("", ErrDnsWrongKeyPath, "Can not open public key file: '%s'", e.Error())
+	}
+	defer pubf.Close()
+	pubkey, e := dns.ReadRR(pubf, pubkeyFile)
+	if e != nil {
+		return nil, nil, NewDnsError("", ErrDnsWrongKeyPath, "Can not parse public key: '%s'", e.Error())
+	}
+
+	privf, e := os.Open(privkeyPath)
+	if e != nil {
+		return nil, nil, NewDnsError("", ErrDnsWrongKeyPath, "Can not open private key file: '%s'", e.Error())
+	}
+	defer privf.Close()
+	key, ok := pubkey.(*dns.KEY)
+	if !ok {
+		return nil, nil, NewDnsError("", ErrDnsWrongKeyPath, "Public key file '%s' must contain a KEY record, generate it with '-T KEY'", pubkeyFile)
+	}
+	privkey, e := key.ReadPrivateKey(privf, privkeyFile)
+	if e != nil {
+		return nil, nil, NewDnsError("", ErrDnsWrongKeyPath, "Can not parse private key file: '%s'", e.Error())
+	}
+	return key, privkey, nil
+}
+
+func (s *sig0Signer) Sign(m *dns.Msg) ([]byte, error) {
+	now := uint32(time.Now().Unix())
+	sig := new(dns.SIG)
+	sig.Hdr.Name = "."
+	sig.Hdr.Rrtype = dns.TypeSIG
+	sig.Hdr.Class = dns.ClassANY
+	sig.Algorithm = s.key.Algorithm
+	sig.SignerName = s.key.Hdr.Name
+	sig.Expiration = now + 300
+	sig.Inception = now - 300
+	sig.KeyTag = s.key.KeyTag()
+
+	return sig.Sign(s.privkey, m)
+}
@@ -0,0 +1,104 @@
+package dnsgate
+
+import (
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Generates a SIG(0) key pair of the algorithm and writes it as dnssec-keygen does, the returned
+// func removes it.
+func writeSig0Key(t *testing.T, algorithm uint8, bits int) (string, *dns.KEY, func()) {
+	key := &dns.KEY{DNSKEY: dns.DNSKEY{Hdr: dns.RR_Header{Name: "h1.cust.rxt.", Rrtype: dns.TypeKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags: 512, Protocol: 3, Algorithm: algorithm}}
+	pk, err := key.Generate(bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "dnsgate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(dir, "Kh1.cust.rxt.+"+dns.AlgorithmToString[algorithm])
+	if err := ioutil.WriteFile(base+".key", []byte(key.String()+"\n"), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(base+".private", []byte(key.PrivateKeyString(pk)), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return base + ".private", key, func() { os.RemoveAll(dir) }
+}
+
+func TestSig0KeyTypes(t *testing.T) {
+	tests := []struct {
+		algorithm uint8
+		bits      int
+	}{
+		{dns.RSASHA256, 2048},
+		{dns.RSASHA512, 2048},
+		{dns.ECDSAP256SHA256, 256},
+		{dns.ECDSAP384SHA384, 384},
+		{dns.ED25519, 256},
+	}
+	for _, tt := range tests {
+		name := dns.AlgorithmToString[tt.algorithm]
+		path, key, cleanup := writeSig0Key(t, tt.algorithm, tt.bits)
+		signer, err := NewSig0Signer(path)
+		cleanup()
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		m := new(dns.Msg)
+		m.SetUpdate("cust.rxt.")
+		m.Insert([]dns.RR{testA("h1.cust.rxt.", "10.0.0.1")})
+		b, err := signer.Sign(m)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		signed := new(dns.Msg)
+		if err := signed.Unpack(b); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		sig, ok := signed.Extra[len(signed.Extra)-1].(*dns.SIG)
+		if !ok {
+			t.Errorf("%s: the message has no SIG", name)
+			continue
+		}
+		if err := sig.Verify(key, b); err != nil {
+			t.Errorf("%s: the signature does not verify: %v", name, err)
+		}
+	}
+}
+
+func TestSig0KeyMismatch(t *testing.T) {
+	path, _, cleanup := writeSig0Key(t, dns.ECDSAP256SHA256, 256)
+	defer cleanup()
+	_, pk, err := readDnsKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		algorithm uint8
+		code      string
+	}{
+		{"unsupported algorithm", dns.RSAMD5, ErrDnsWrongKeyPath},
+		{"RSA algorithm of ECDSA key", dns.RSASHA256, ErrDnsSigningError},
+		{"ED25519 algorithm of ECDSA key", dns.ED25519, ErrDnsSigningError},
+	}
+	for _, tt := range tests {
+		key := &dns.KEY{DNSKEY: dns.DNSKEY{Hdr: dns.RR_Header{Name: "h1.cust.rxt."}, Algorithm: tt.algorithm}}
+		if _, err := asSig0Signer(key, pk); err == nil || err.(*DnsError).Code != tt.code {
+			t.Errorf("%s: want %s, got %v", tt.name, tt.code, err)
+		}
+	}
+	if _, err := NewSig0Signer(filepath.Join(filepath.Dir(path), "Kh1.cust.rxt.key")); err == nil {
+		t.Error("a path without the .private extension is accepted")
+	}
+}
@@ -0,0 +1,9 @@
+package dnsgate
+
+import (
+	"time"
+)
+
+func NewTcpGate(address string, timeout time.Duration) (*connGate, error) {
+	return dialGate("tcp", address, nil, timeout)
+}
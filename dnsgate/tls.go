@@ -0,0 +1,35 @@
+package dnsgate
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"time"
+)
+
+// Dials a DNS server over TLS (RFC 7858). If ServerName of conf is empty the host part of address is verified.
+func NewTlsGate(address string, conf *tls.Config, timeout time.Duration) (*connGate, error) {
+	if conf == nil {
+		conf = &tls.Config{}
+	}
+	return dialGate("tcp", address, conf, timeout)
+}
+
+// Creates a TLS configuration trusting certificates from the PEM bundle at caPath.
+// If caPath is empty the system roots are used.
+func NewTlsConfig(caPath string) (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caPath == "" {
+		return conf, nil
+	}
+	pem, e := ioutil.ReadFile(caPath)
+	if e != nil {
+		return nil, NewDnsError("", ErrDnsWrongCaPath, "Can not read CA bundle: '%s'", e.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, NewDnsError("", ErrDnsWrongCaPath, "No certificates found in CA bundle '%s'", caPath)
+	}
+	conf.RootCAs = pool
+	return conf, nil
+}
@@ -0,0 +1,125 @@
+package dnsgate
+
+import (
+	"encoding/base64"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Signs messages with a TSIG shared secret (RFC 2845).
+type tsigSigner struct {
+	name      string
+	algorithm string
+	secret    string
+}
+
+var tsigAlgorithms = map[string]string{
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// Creates a TSIG signer from a BIND key file, as generated by tsig-keygen:
+//
+//	key "director.example.com" {
+//		algorithm hmac-sha256;
+//		secret "c2VjcmV0...";
+//	};
+func NewTsigSigner(keyPath string) (Signer, error) {
+	b, e := ioutil.ReadFile(keyPath)
+	if e != nil {
+		return nil, NewDnsError("", ErrDnsWrongKeyPath, "Can not open TSIG key file: '%s'", e.Error())
+	}
+	s, e := parseTsigKey(string(b))
+	if e != nil {
+		return nil, NewDnsError("", ErrDnsWrongKeyPath, "Can not parse TSIG key file '%s': %s", keyPath, e.Error())
+	}
+	return s, nil
+}
+
+// Splits a BIND configuration into tokens skipping comments. Quoted strings are returned unquoted.
+func tokenizeBindConf(conf string) []string {
+	var tokens []string
+	for i := 0; i < len(conf); {
+		c := conf[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '#' || strings.HasPrefix(conf[i:], "//"):
+			for i < len(conf) && conf[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(conf[i:], "/*"):
+			if end := strings.Index(conf[i+2:], "*/"); end == -1 {
+				i = len(conf)
+			} else {
+				i += end + 4
+			}
+		case c == '{' || c == '}' || c == ';':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			end := strings.IndexByte(conf[i+1:], '"')
+			if end == -1 {
+				end = len(conf) - i - 1
+			}
+			tokens = append(tokens, conf[i+1:i+1+end])
+			i += end + 2
+		default:
+			start := i
+			for i < len(conf) && !unicode.IsSpace(rune(conf[i])) && strings.IndexByte("{};\"", conf[i]) == -1 {
+				i++
+			}
+			tokens = append(tokens, conf[start:i])
+		}
+	}
+	return tokens
+}
+
+func parseTsigKey(conf string) (*tsigSigner, error) {
+	t := tokenizeBindConf(conf)
+	if len(t) < 3 || t[0] != "key" || t[2] != "{" {
+		return nil, NewDnsError("", ErrDnsWrongKeyPath, "'key \"<name>\" {' statement expected")
+	}
+	s := &tsigSigner{name: dns.Fqdn(strings.ToLower(t[1]))}
+	for i := 3; i < len(t) && t[i] != "}"; i++ {
+		if i+2 >= len(t) || t[i+2] != ";" {
+			return nil, NewDnsError("", ErrDnsWrongKeyPath, "Statement '%s' is not terminated", t[i])
+		}
+		switch t[i] {
+		case "algorithm":
+			algorithm, ok := tsigAlgorithms[strings.ToLower(strings.TrimSuffix(t[i+1], "."))]
+			if !ok {
+				return nil, NewDnsError("", ErrDnsWrongKeyPath, "Unsupported TSIG algorithm '%s'", t[i+1])
+			}
+			s.algorithm = algorithm
+		case "secret":
+			if _, e := base64.StdEncoding.DecodeString(t[i+1]); e != nil {
+				return nil, NewDnsError("", ErrDnsWrongKeyPath, "Secret is not base64 encoded: %s", e.Error())
+			}
+			s.secret = t[i+1]
+		}
+		i += 2
+	}
+	if s.algorithm == "" || s.secret == "" {
+		return nil, NewDnsError("", ErrDnsWrongKeyPath, "Both 'algorithm' and 'secret' must be specified for key '%s'", s.name)
+	}
+	return s, nil
+}
+
+func (s *tsigSigner) Sign(m *dns.Msg) ([]byte, error) {
+	mb, _, e := s.signRequest(m)
+	return mb, e
+}
+
+func (s *tsigSigner) signRequest(m *dns.Msg) ([]byte, string, error) {
+	m.SetTsig(s.name, s.algorithm, 300, time.Now().Unix())
+	return dns.TsigGenerate(m, s.secret, "", false)
+}
+
+// The response is signed over the MAC of the request, so it can not be replayed or forged (RFC 2845 4.1).
+func (s *tsigSigner) verifyResponse(rb []byte, requestMac string) error {
+	return dns.TsigVerify(rb, s.secret, requestMac, false)
+}
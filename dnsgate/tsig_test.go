@@ -0,0 +1,103 @@
+package dnsgate
+
+import (
+	"github.com/miekg/dns"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUpdateResponseMustBeSigned(t *testing.T) {
+	key, cleanup := writeTsigKey(t)
+	defer cleanup()
+	signer, err := NewTsigSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := signer.(*tsigSigner)
+
+	tests := []struct {
+		name string
+		// signs the reply, if not nil
+		sign func(m *dns.Msg)
+		ok   bool
+	}{
+		{"unsigned", nil, false},
+		{"signed with the key", func(m *dns.Msg) {
+			m.SetTsig(s.name, s.algorithm, 300, time.Now().Unix())
+		}, true},
+		{"signed with another key", func(m *dns.Msg) {
+			m.SetTsig("other.cust.rxt.", s.algorithm, 300, time.Now().Unix())
+		}, false},
+	}
+	for _, tt := range tests {
+		port := freePort(t)
+		sign := tt.sign
+		srv := &dns.Server{Addr: "127.0.0.1:" + strconv.Itoa(int(port)), Net: "udp", MsgAcceptFunc: acceptQueryOrUpdate,
+			TsigSecret: map[string]string{s.name: s.secret, "other.cust.rxt.": "b3RoZXI="},
+			Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+				m := new(dns.Msg)
+				m.SetReply(r)
+				if sign != nil {
+					sign(m)
+				}
+				w.WriteMsg(m)
+			})}
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ListenAndServe()
+		<-started
+
+		g, err := NewPooledDnsGate("127.0.0.1", port, &Config{Net: NetUdp, TsigKeyPath: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = g.Add("cust.rxt.", []dns.RR{testA("h1.cust.rxt.", "10.0.0.1")})
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if de, ok := err.(*DnsError); !tt.ok && (!ok || de.Code != ErrDnsSigningError) {
+			t.Errorf("%s: want %s, got %v", tt.name, ErrDnsSigningError, err)
+		}
+		srv.Shutdown()
+	}
+}
+
+func TestParseTsigKey(t *testing.T) {
+	tests := []struct {
+		name, conf, keyname, algorithm string
+		ok                             bool
+	}{
+		{"tsig-keygen output", testTsigKey, "director.cust.rxt.", dns.HmacSHA256, true},
+		{"comments and upper case", `# generated
+			key "Director.Cust.Rxt." { // the key
+				algorithm HMAC-SHA512; /* sha512
+				is fine too */
+				secret "c2VjcmV0";
+			};`, "director.cust.rxt.", dns.HmacSHA512, true},
+		{"unknown statements are skipped", `key "d.cust.rxt" { algorithm hmac-sha256; owner "x"; secret "c2VjcmV0"; };`,
+			"d.cust.rxt.", dns.HmacSHA256, true},
+		{"unsupported algorithm", `key "d.cust.rxt" { algorithm hmac-md5; secret "c2VjcmV0"; };`, "", "", false},
+		{"secret not base64", `key "d.cust.rxt" { algorithm hmac-sha256; secret "not base64!"; };`, "", "", false},
+		{"no secret", `key "d.cust.rxt" { algorithm hmac-sha256; };`, "", "", false},
+		{"not terminated", `key "d.cust.rxt" { algorithm hmac-sha256 secret "c2VjcmV0"; };`, "", "", false},
+		{"no key statement", `server 10.0.0.1 { keys { d.cust.rxt; }; };`, "", "", false},
+		{"empty", "", "", "", false},
+	}
+	for _, tt := range tests {
+		s, err := parseTsigKey(tt.conf)
+		if !tt.ok {
+			if de, ok := err.(*DnsError); !ok || de.Code != ErrDnsWrongKeyPath {
+				t.Errorf("%s: want %s, got %v", tt.name, ErrDnsWrongKeyPath, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if s.name != tt.keyname || s.algorithm != tt.algorithm {
+			t.Errorf("%s: key '%s' %s, want '%s' %s", tt.name, s.name, s.algorithm, tt.keyname, tt.algorithm)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package dnsgate
+
+import (
+	"github.com/miekg/dns"
+)
+
+// A condition the zone must meet for an update to be applied, see RFC 2136 section 2.4.
+type Prereq func(m *dns.Msg)
+
+// The name owns at least one RR.
+func NameUsed(name string) Prereq {
+	return func(m *dns.Msg) {
+		m.NameUsed([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: name}}})
+	}
+}
+
+// The name owns no RRs.
+func NameNotUsed(name string) Prereq {
+	return func(m *dns.Msg) {
+		m.NameNotUsed([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: name}}})
+	}
+}
+
+// The name owns an RRset of the type.
+func RRsetUsed(name string, typ uint16) Prereq {
+	return func(m *dns.Msg) {
+		m.RRsetUsed([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: name, Rrtype: typ}}})
+	}
+}
+
+// The name owns no RRset of the type.
+func RRsetNotUsed(name string, typ uint16) Prereq {
+	return func(m *dns.Msg) {
+		m.RRsetNotUsed([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: name, Rrtype: typ}}})
+	}
+}
+
+// The RRsets of the names and types of rrs consist exactly of rrs.
+func RRsetEquals(rrs []dns.RR) Prereq {
+	return func(m *dns.Msg) {
+		for _, rr := range rrs {
+			c := dns.Copy(rr)
+			c.Header().Ttl = 0
+			m.Used([]dns.RR{c})
+		}
+	}
+}
+
+// An update applied in one message: if all prerequisites are met, RRs and RRsets are removed first
+// and then RRs are inserted, otherwise nothing is changed.
+type Update struct {
+	Prereqs []Prereq
+	// specific RRs to remove
+	Remove []dns.RR
+	// RRsets to remove by the names and types of the RRs
+	RemoveRRsets []dns.RR
+	// names to remove all RRsets of
+	RemoveNames []string
+	Insert      []dns.RR
+}
+
+func (u *Update) msg(zone string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	for _, p := range u.Prereqs {
+		p(m)
+	}
+	if len(u.Remove) > 0 {
+		m.Remove(u.Remove)
+	}
+	if len(u.RemoveRRsets) > 0 {
+		m.RemoveRRset(u.RemoveRRsets)
+	}
+	for _, name := range u.RemoveNames {
+		any := new(dns.ANY)
+		any.Hdr = dns.RR_Header{name, dns.TypeANY, dns.ClassINET, 0, 0}
+		m.RemoveName([]dns.RR{any})
+	}
+	if len(u.Insert) > 0 {
+		m.Insert(u.Insert)
+	}
+	return m
+}
+
+// Builds an update message inserting the RRs into the zone.
+func newAddMsg(zone string, rrs []dns.RR) *dns.Msg {
+	return (&Update{Insert: rrs}).msg(zone)
+}
+
+// Builds an update message deleting the given RRs and then all RRsets of name if it is not empty.
+func newRemoveMsg(zone string, name string, rrs []dns.RR) *dns.Msg {
+	u := &Update{Remove: rrs}
+	if name != "" {
+		u.RemoveNames = []string{name}
+	}
+	return u.msg(zone)
+}
+
+// Reports whether the response code tells that a prerequisite is not met.
+func isPrereqRcode(rcode int) bool {
+	switch rcode {
+	case dns.RcodeNameError, dns.RcodeYXDomain, dns.RcodeYXRrset, dns.RcodeNXRrset:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+// Package hmacauth signs director API requests with HMAC keys, the same way for the client and the server.
+package hmacauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// The scheme of the Authorization header of HMAC signed requests:
+// "Authorization: Director-HMAC-SHA256 <principal>:<hex signature>".
+const Scheme = "Director-HMAC-SHA256"
+
+// Returns the signature of the request: HMAC-SHA256 of the method, the request URI, the Date
+// header and the hex SHA-256 of the body joined by new lines.
+func Sign(key []byte, method, uri, date string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(method + "\n" + uri + "\n" + date + "\n" + hex.EncodeToString(sum[:])))
+	return mac.Sum(nil)
+}
+
+// Returns the value of the Authorization header of the request signed by the principal.
+func Authorization(principal string, key []byte, method, uri, date string, body []byte) string {
+	return Scheme + " " + principal + ":" + hex.EncodeToString(Sign(key, method, uri, date, body))
+}
@@ -0,0 +1,354 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"git.reaxoft.loc/infomir/director/hmacauth"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ErrUnauthorized = "unauthorized"
+	ErrForbidden    = "forbidden"
+)
+
+// The scheme of the Authorization header of HMAC signed requests:
+// "Authorization: Director-HMAC-SHA256 <principal>:<hex signature>".
+const HmacScheme = hmacauth.Scheme
+
+// How far the Date header of a signed request may be off the server clock.
+const maxHmacSkew = 5 * time.Minute
+
+// Authenticates requests of one kind of credentials.
+type Authenticator interface {
+	// Returns the principal the request is made by, or "" if the request carries no credentials
+	// of the kind. An error means the credentials are present but not valid.
+	Authenticate(r *http.Request) (string, error)
+}
+
+type tokenAuth struct {
+	tokens map[string]string
+}
+
+// Authenticates "Authorization: Bearer <token>" by static tokens, tokens maps a token to its principal.
+func NewTokenAuth(tokens map[string]string) Authenticator {
+	return &tokenAuth{tokens}
+}
+
+func (a *tokenAuth) Authenticate(r *http.Request) (string, error) {
+	token := bearerToken(r)
+	if token == "" || isJwt(token) {
+		return "", nil
+	}
+	for t, principal := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return principal, nil
+		}
+	}
+	return "", fmt.Errorf("unknown token")
+}
+
+type hmacAuth struct {
+	keys map[string][]byte
+}
+
+// Authenticates HMAC signed requests, keys maps a principal to its secret. The signature is
+// made by hmacauth.Sign.
+func NewHmacAuth(keys map[string][]byte) Authenticator {
+	return &hmacAuth{keys}
+}
+
+func (a *hmacAuth) Authenticate(r *http.Request) (string, error) {
+	scheme, cred := authorization(r)
+	if scheme != strings.ToLower(HmacScheme) {
+		return "", nil
+	}
+	i := strings.LastIndex(cred, ":")
+	if i < 0 {
+		return "", fmt.Errorf("malformed signature")
+	}
+	principal := cred[:i]
+	sig, err := hex.DecodeString(cred[i+1:])
+	if err != nil {
+		return "", fmt.Errorf("malformed signature")
+	}
+	key, ok := a.keys[principal]
+	if !ok {
+		return "", fmt.Errorf("unknown key '%s'", principal)
+	}
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return "", fmt.Errorf("Date header is required")
+	}
+	if d := time.Since(date); d > maxHmacSkew || d < -maxHmacSkew {
+		return "", fmt.Errorf("Date header is too far from the server time")
+	}
+	// the body is read to be signed and put back for the handler
+	var body []byte
+	if r.Body != nil {
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return "", err
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if !hmac.Equal(sig, hmacauth.Sign(key, r.Method, r.URL.RequestURI(), r.Header.Get("Date"), body)) {
+		return "", fmt.Errorf("signature mismatch")
+	}
+	return principal, nil
+}
+
+// Returns the lower case scheme and the credentials of the Authorization header.
+func authorization(r *http.Request) (string, string) {
+	h := strings.TrimSpace(r.Header.Get("Authorization"))
+	i := strings.IndexByte(h, ' ')
+	if i < 0 {
+		return strings.ToLower(h), ""
+	}
+	return strings.ToLower(h[:i]), strings.TrimSpace(h[i+1:])
+}
+
+func bearerToken(r *http.Request) string {
+	if scheme, cred := authorization(r); scheme == "bearer" {
+		return cred
+	}
+	return ""
+}
+
+// Stands for the host names of the client certificate in Rule.Servers.
+const SelfServer = "$self"
+
+// What a principal may change. Empty Types allows any type, empty Prefixes any name and empty
+// Servers any server. A principal restricted to Servers may not remove whole services, and only
+// a rule without restrictions allows reconciliation.
+type Rule struct {
+	// service types, e.g. "_bo._rest_http._tcp.cust.rxt"
+	Types []string `json:"types"`
+	// prefixes of service names, e.g. "bo" allows "bo1._bo._rest_http._tcp.cust.rxt"
+	Prefixes []string `json:"prefixes"`
+	// servers of instances, e.g. "szaytsev.cust.rxt" or SelfServer
+	Servers []string `json:"servers"`
+}
+
+func (rl *Rule) allows(srvtype, srvname, server string, self []string) bool {
+	if !matchAny(rl.Types, srvtype, func(t, v string) bool { return t == v }) ||
+		!matchAny(rl.Prefixes, srvname, strings.HasPrefix) {
+		return false
+	}
+	if len(rl.Servers) == 0 {
+		return true
+	}
+	var servers []string
+	for _, s := range rl.Servers {
+		if s == SelfServer {
+			servers = append(servers, self...)
+		} else {
+			servers = append(servers, s)
+		}
+	}
+	return server != "" && matchAny(servers, server, func(s, v string) bool { return s == v })
+}
+
+func (rl *Rule) allowsAll() bool {
+	return len(rl.Types) == 0 && len(rl.Prefixes) == 0 && len(rl.Servers) == 0
+}
+
+func matchAny(patterns []string, v string, match func(string, string) bool) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if match(normName(v), normName(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+func normName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Authentication and authorization of the mutating routes.
+type Auth struct {
+	authenticators []Authenticator
+	rules          map[string]*Rule
+	// rule of the certificate principals without their own rule
+	certRule *Rule
+}
+
+// The auth file, e.g.:
+//
+//	{
+//	  "tokens": {"6f1c0e...": "billing"},
+//	  "hmac": {"billing": "<base64 secret>"},
+//	  "jwks": "/etc/director/jwks.json", "jwt_issuer": "https://sso.cust.rxt", "jwt_audience": "director",
+//	  "rules": {
+//	    "billing": {"types": ["_bo._rest_http._tcp.cust.rxt"], "prefixes": ["bo"]},
+//	    "cert:bo1.cust.rxt": {"servers": ["$self"]}
+//	  }
+//	}
+//
+// The principal of a JWT is its "sub" claim, of a client certificate "cert:" and its common name
+// (see certPrincipal). Principals without rules may not change services.
+type authFile struct {
+	Tokens      map[string]string `json:"tokens"`
+	Hmac        map[string]string `json:"hmac"`
+	Jwks        string            `json:"jwks"`
+	JwtIssuer   string            `json:"jwt_issuer"`
+	JwtAudience string            `json:"jwt_audience"`
+	Rules       map[string]*Rule  `json:"rules"`
+}
+
+// Loads the auth file, see authFile.
+func LoadAuth(path string) (*Auth, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f authFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("bad auth file '%s': %s", path, err.Error())
+	}
+	a := &Auth{rules: f.Rules}
+	if len(f.Tokens) > 0 {
+		a.authenticators = append(a.authenticators, NewTokenAuth(f.Tokens))
+	}
+	if len(f.Hmac) > 0 {
+		keys := make(map[string][]byte, len(f.Hmac))
+		for principal, secret := range f.Hmac {
+			if keys[principal], err = base64.StdEncoding.DecodeString(secret); err != nil {
+				return nil, fmt.Errorf("bad HMAC secret of '%s': %s", principal, err.Error())
+			}
+		}
+		a.authenticators = append(a.authenticators, NewHmacAuth(keys))
+	}
+	if f.Jwks != "" {
+		ja, err := NewJwtAuth(f.Jwks, f.JwtIssuer, f.JwtAudience)
+		if err != nil {
+			return nil, err
+		}
+		a.authenticators = append(a.authenticators, ja)
+	}
+	return a, nil
+}
+
+// Creates Auth of the authenticators and the rules of the principals.
+func NewAuth(rules map[string]*Rule, authenticators ...Authenticator) *Auth {
+	return &Auth{authenticators: authenticators, rules: rules}
+}
+
+// Auth of client certificates only: any verified certificate may change the instances on its own hosts.
+func newSelfAuth() *Auth {
+	return &Auth{certRule: &Rule{Servers: []string{SelfServer}}}
+}
+
+// Returns the rule of the principal, nil if it may not change anything.
+func (a *Auth) rule(principal string) *Rule {
+	if rule, ok := a.rules[principal]; ok {
+		return rule
+	}
+	if strings.HasPrefix(principal, CertPrincipalPrefix) {
+		return a.certRule
+	}
+	return nil
+}
+
+// Returns the principal of the request by the first authenticator recognizing its credentials,
+// or by the verified client certificate if no authenticator does.
+func (a *Auth) authenticate(r *http.Request) (string, error) {
+	for _, au := range a.authenticators {
+		principal, err := au.Authenticate(r)
+		if err != nil {
+			return "", err
+		}
+		if principal != "" {
+			return principal, nil
+		}
+	}
+	if cert := clientCert(r); cert != nil {
+		if principal := certPrincipal(cert); principal != "" {
+			return principal, nil
+		}
+	}
+	return "", fmt.Errorf("no credentials")
+}
+
+type principalKey struct{}
+
+// Authenticates the request before passing it to the handler, nothing is checked without auth.
+func (ds *DirectorServer) secured(h func(http.ResponseWriter, *http.Request, httprouter.Params)) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	if ds.auth == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		principal, err := ds.auth.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="director"`)
+			returnError(w, &ServerError{http.StatusUnauthorized, ErrUnauthorized, "Authentication failed: " + err.Error()})
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)), p)
+	}
+}
+
+// Like secured, and also authorizes the change of the instance in the "name" path parameter
+// and the "server" query parameter.
+func (ds *DirectorServer) securedName(h func(http.ResponseWriter, *http.Request, httprouter.Params)) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return ds.secured(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		name := p.ByName("name")
+		if e := ds.authorize(r, typeOfName(name), name, r.URL.Query().Get("server")); e != nil {
+			returnError(w, e)
+			return
+		}
+		h(w, r, p)
+	})
+}
+
+// Checks the principal of the request may change the instance at server of the service of
+// the type, server is empty for the whole service.
+func (ds *DirectorServer) authorize(r *http.Request, srvtype, srvname, server string) error {
+	if ds.auth == nil {
+		return nil
+	}
+	principal, _ := r.Context().Value(principalKey{}).(string)
+	var self []string
+	if cert := clientCert(r); cert != nil {
+		self = certNames(cert)
+	}
+	if rule := ds.auth.rule(principal); rule != nil && rule.allows(srvtype, srvname, server, self) {
+		return nil
+	}
+	return &ServerError{http.StatusForbidden, ErrForbidden, fmt.Sprintf("'%s' may not change service '%s' of type '%s'", principal, srvname, srvtype)}
+}
+
+// Checks the principal of the request may change any service, as changes of the whole
+// directory like reconciliation require.
+func (ds *DirectorServer) authorizeAll(r *http.Request) error {
+	if ds.auth == nil {
+		return nil
+	}
+	principal, _ := r.Context().Value(principalKey{}).(string)
+	if rule := ds.auth.rule(principal); rule != nil && rule.allowsAll() {
+		return nil
+	}
+	return &ServerError{http.StatusForbidden, ErrForbidden, fmt.Sprintf("'%s' may not change all services", principal)}
+}
+
+// Returns the type of the service name, i.e. the name without its first label.
+func typeOfName(srvname string) string {
+	if i := strings.IndexByte(srvname, '.'); i >= 0 {
+		return srvname[i+1:]
+	}
+	return ""
+}
@@ -0,0 +1,174 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"git.reaxoft.loc/infomir/director/core"
+	"git.reaxoft.loc/infomir/director/dnsgate"
+	"git.reaxoft.loc/infomir/director/hmacauth"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serves the routes of a director on the memory gate with the auth.
+func newTestServer(auth *Auth) (*DirectorServer, *director.Director, http.Handler) {
+	ds := &DirectorServer{root: "/director", domain: "cust.rxt", auth: auth}
+	dr := director.NewDirectorWithGate("cust.rxt", dnsgate.NewMemDnsGate())
+	router := httprouter.New()
+	ds.route(router, ds.root, dr)
+	return ds, dr, router
+}
+
+func serve(h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestTypeRuleCanNotBeBypassedByName(t *testing.T) {
+	auth := NewAuth(map[string]*Rule{"bo": {Types: []string{"_bo._rest_http._tcp.cust.rxt"}}}, NewTokenAuth(map[string]string{"tok": "bo"}))
+	_, dr, h := newTestServer(auth)
+
+	tests := []struct {
+		method, path, body string
+		status             int
+	}{
+		{"PUT", "/director/services/_bo._rest_http._tcp.cust.rxt",
+			`{"name": "bo1._billing._rest_http._tcp.cust.rxt", "server": "h1.cust.rxt", "port": 80}`, http.StatusBadRequest},
+		{"POST", "/director/services/batch",
+			`[{"type": "_bo._rest_http._tcp.cust.rxt", "name": "bo1._billing._rest_http._tcp.cust.rxt", "server": "h1.cust.rxt", "port": 80}]`, http.StatusBadRequest},
+		{"PUT", "/director/services/_billing._rest_http._tcp.cust.rxt",
+			`{"name": "bo1._billing._rest_http._tcp.cust.rxt", "server": "h1.cust.rxt", "port": 80}`, http.StatusForbidden},
+		{"PUT", "/director/services/_bo._rest_http._tcp.cust.rxt",
+			`{"name": "bo1._bo._rest_http._tcp.cust.rxt", "server": "h1.cust.rxt", "port": 80}`, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		if w := serve(h, tt.method, tt.path, "tok", tt.body); w.Code != tt.status {
+			t.Errorf("%s %s %s: status %d, want %d: %s", tt.method, tt.path, tt.body, w.Code, tt.status, w.Body.String())
+		}
+	}
+	if srvs, _ := dr.FindDnsSrvInstances("bo1._billing._rest_http._tcp.cust.rxt"); len(srvs) != 0 {
+		t.Errorf("instances of another type's service are registered: %v", srvs)
+	}
+}
+
+func TestCertPrincipals(t *testing.T) {
+	all := map[string]*Rule{"bo": {}}
+	tests := []struct {
+		name   string
+		auth   *Auth
+		cn     string
+		server string
+		status int
+	}{
+		{"own host", newSelfAuth(), "h1.cust.rxt", "h1.cust.rxt", http.StatusCreated},
+		{"another host", newSelfAuth(), "h1.cust.rxt", "h2.cust.rxt", http.StatusForbidden},
+		{"no certificate", newSelfAuth(), "", "h1.cust.rxt", http.StatusUnauthorized},
+		{"certificate named as a token principal", NewAuth(all), "bo", "h2.cust.rxt", http.StatusForbidden},
+		{"rule of the certificate", NewAuth(map[string]*Rule{"cert:bo": {}}), "bo", "h2.cust.rxt", http.StatusCreated},
+	}
+	for _, tt := range tests {
+		_, _, h := newTestServer(tt.auth)
+		r := httptest.NewRequest("PUT", "/director/services/_bo._rest_http._tcp.cust.rxt",
+			strings.NewReader(`{"name": "bo1._bo._rest_http._tcp.cust.rxt", "server": "`+tt.server+`", "port": 80}`))
+		r.Header.Set("Content-Type", "application/json")
+		if tt.cn != "" {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: tt.cn}, DNSNames: []string{tt.cn}}
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body.String())
+		}
+	}
+}
+
+func TestHeartbeatAndReconcileAuth(t *testing.T) {
+	auth := NewAuth(map[string]*Rule{
+		"bo":      {Types: []string{"_bo._rest_http._tcp.cust.rxt"}},
+		"billing": {Types: []string{"_billing._rest_http._tcp.cust.rxt"}},
+		"h2":      {Servers: []string{"h2.cust.rxt"}},
+		"admin":   {},
+	}, NewTokenAuth(map[string]string{"tbo": "bo", "tbilling": "billing", "th2": "h2", "tadmin": "admin"}))
+	_, dr, h := newTestServer(auth)
+	lease, e := dr.RegDnsSrv("_bo._rest_http._tcp.cust.rxt",
+		&director.DnsService{Name: "bo1._bo._rest_http._tcp.cust.rxt", Server: "h1.cust.rxt", Port: 80, LeaseTtl: 30})
+	if e != nil || lease == nil {
+		t.Fatalf("lease is not granted: %v", e)
+	}
+
+	tests := []struct {
+		method, path, token string
+		status              int
+	}{
+		{"PUT", "/director/leases/" + lease.Id + "/heartbeat", "tbo", http.StatusOK},
+		{"PUT", "/director/leases/" + lease.Id + "/heartbeat", "tbilling", http.StatusForbidden},
+		{"PUT", "/director/leases/" + lease.Id + "/heartbeat", "th2", http.StatusForbidden},
+		{"PUT", "/director/leases/" + lease.Id + "/heartbeat", "tadmin", http.StatusOK},
+		{"POST", "/director/services/reconcile", "tbo", http.StatusForbidden},
+		{"POST", "/director/services/reconcile", "th2", http.StatusForbidden},
+		{"POST", "/director/services/reconcile", "tadmin", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := serve(h, tt.method, tt.path, tt.token, ""); w.Code != tt.status {
+			t.Errorf("%s %s as '%s': status %d, want %d: %s", tt.method, tt.path, tt.token, w.Code, tt.status, w.Body.String())
+		}
+	}
+}
+
+func TestHmacAuth(t *testing.T) {
+	key := []byte("secret")
+	a := NewHmacAuth(map[string][]byte{"billing": key})
+	const uri, body = "/director/services/_bo._rest_http._tcp.cust.rxt", `{"name": "bo1._bo._rest_http._tcp.cust.rxt"}`
+	now := time.Now().UTC()
+	sign := func(key []byte, date time.Time, body string) string {
+		return hmacauth.Authorization("billing", key, "PUT", uri, date.Format(http.TimeFormat), []byte(body))
+	}
+	tests := []struct {
+		name, authorization string
+		date                time.Time
+		principal           string
+		ok                  bool
+	}{
+		{"signed", sign(key, now, body), now, "billing", true},
+		{"other scheme", "Bearer tok", now, "", true},
+		{"another key", sign([]byte("other"), now, body), now, "", false},
+		{"another body", sign(key, now, `{"name": "bo2._bo._rest_http._tcp.cust.rxt"}`), now, "", false},
+		{"unknown principal", HmacScheme + " bo:00", now, "", false},
+		{"malformed signature", HmacScheme + " billing:xyz", now, "", false},
+		{"no principal", HmacScheme + " 00", now, "", false},
+		{"old date", sign(key, now.Add(-10*time.Minute), body), now.Add(-10 * time.Minute), "", false},
+		{"future date", sign(key, now.Add(10*time.Minute), body), now.Add(10 * time.Minute), "", false},
+		{"no date", sign(key, now, body), time.Time{}, "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("PUT", uri, strings.NewReader(body))
+		r.Header.Set("Authorization", tt.authorization)
+		if !tt.date.IsZero() {
+			r.Header.Set("Date", tt.date.Format(http.TimeFormat))
+		}
+		principal, err := a.Authenticate(r)
+		if (err == nil) != tt.ok || principal != tt.principal {
+			t.Errorf("%s: '%s', %v, want '%s'", tt.name, principal, err, tt.principal)
+		}
+		if tt.principal != "" {
+			if b, _ := ioutil.ReadAll(r.Body); string(b) != body {
+				t.Errorf("%s: body '%s' is not put back", tt.name, b)
+			}
+		}
+	}
+}
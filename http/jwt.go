@@ -0,0 +1,245 @@
+package http
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How far exp and nbf claims may be off the server clock.
+const jwtLeeway = 30 * time.Second
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwtAuth struct {
+	keys     map[string]crypto.PublicKey
+	issuer   string
+	audience string
+}
+
+// Authenticates "Authorization: Bearer <JWT>" signed with RS256/384/512 or ES256/384/512 by a key
+// of the JWKS file (RFC 7517). The iss and aud claims are checked if issuer and audience are not empty.
+func NewJwtAuth(jwksPath, issuer, audience string) (Authenticator, error) {
+	b, err := ioutil.ReadFile(jwksPath)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("bad JWKS file '%s': %s", jwksPath, err.Error())
+	}
+	a := &jwtAuth{keys: make(map[string]crypto.PublicKey), issuer: issuer, audience: audience}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pk, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("bad key '%s' in JWKS file '%s': %s", k.Kid, jwksPath, err.Error())
+		}
+		a.keys[k.Kid] = pk
+	}
+	if len(a.keys) == 0 {
+		return nil, fmt.Errorf("JWKS file '%s' has no signature keys", jwksPath)
+	}
+	return a, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64Int(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64Int(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := b64Int(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64Int(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve '%s'", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+}
+
+func b64Int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func isJwt(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+type jwtClaims struct {
+	Sub string          `json:"sub"`
+	Iss string          `json:"iss"`
+	Aud json.RawMessage `json:"aud"`
+	Exp *float64        `json:"exp"`
+	Nbf *float64        `json:"nbf"`
+}
+
+func (a *jwtAuth) Authenticate(r *http.Request) (string, error) {
+	token := bearerToken(r)
+	if token == "" || !isJwt(token) {
+		return "", nil
+	}
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return "", err
+	}
+	key, ok := a.keys[header.Kid]
+	if !ok && header.Kid == "" && len(a.keys) == 1 {
+		for _, k := range a.keys {
+			key, ok = k, true
+		}
+	}
+	if !ok {
+		return "", fmt.Errorf("unknown JWT key '%s'", header.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed JWT signature")
+	}
+	if err := verifyJwt(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return "", err
+	}
+
+	var claims jwtClaims
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if claims.Exp == nil || now.After(unixTime(*claims.Exp).Add(jwtLeeway)) {
+		return "", fmt.Errorf("JWT is expired")
+	}
+	if claims.Nbf != nil && now.Add(jwtLeeway).Before(unixTime(*claims.Nbf)) {
+		return "", fmt.Errorf("JWT is not valid yet")
+	}
+	if a.issuer != "" && claims.Iss != a.issuer {
+		return "", fmt.Errorf("JWT issuer '%s' is not trusted", claims.Iss)
+	}
+	if a.audience != "" && !hasAudience(claims.Aud, a.audience) {
+		return "", fmt.Errorf("JWT is not issued for '%s'", a.audience)
+	}
+	if claims.Sub == "" {
+		return "", fmt.Errorf("JWT has no subject")
+	}
+	return claims.Sub, nil
+}
+
+func decodeJwtPart(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("malformed JWT")
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("malformed JWT: %s", err.Error())
+	}
+	return nil
+}
+
+// The curve sizes of the ECDSA algorithms, RFC 7518 section 3.4.
+var esCurveBits = map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+
+func verifyJwt(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	if len(alg) != 5 || hashes[alg[2:]] == 0 {
+		return fmt.Errorf("unsupported JWT algorithm '%s'", alg)
+	}
+	h := hashes[alg[2:]]
+	hh := h.New()
+	hh.Write([]byte(signed))
+	digest := hh.Sum(nil)
+
+	switch pk := key.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" || rsa.VerifyPKCS1v15(pk, h, digest, sig) != nil {
+			return fmt.Errorf("JWT signature mismatch")
+		}
+	case *ecdsa.PublicKey:
+		bits := pk.Curve.Params().BitSize
+		size := (bits + 7) / 8
+		if alg[:2] != "ES" || esCurveBits[alg] != bits || len(sig) != 2*size {
+			return fmt.Errorf("JWT signature mismatch")
+		}
+		rr, ss := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pk, digest, rr, ss) {
+			return fmt.Errorf("JWT signature mismatch")
+		}
+	default:
+		return fmt.Errorf("unsupported JWT key type %T", key)
+	}
+	return nil
+}
+
+func unixTime(sec float64) time.Time {
+	return time.Unix(int64(sec), 0)
+}
+
+// The aud claim is either a string or an array of strings.
+func hasAudience(raw json.RawMessage, audience string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == audience
+	}
+	var many []string
+	json.Unmarshal(raw, &many)
+	for _, a := range many {
+		if a == audience {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package http
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Builds a JWT of the claims signed by the key with alg.
+func signJwt(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	h := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[2:]]
+	hh := h.New()
+	hh.Write([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, h, hh.Sum(nil)); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, hh.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestJwtAuth(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		{"kty": "EC", "kid": "enc", "use": "enc", "crv": "P-256", "x": b64(otherKey.X.Bytes()), "y": b64(otherKey.Y.Bytes())},
+	}})
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(path, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewJwtAuth(path, "https://idp.cust.rxt", "director")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keys of other types are rejected by the JWKS loader, one is put in place to reach the signature check
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.(*jwtAuth).keys["ed"] = edKey
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "billing", "iss": "https://idp.cust.rxt", "aud": "director", "exp": now + 60}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	parts := strings.Split(signJwt(t, "ES256", "ec", ecKey, claims(nil)), ".")
+	payload, _ := json.Marshal(claims(map[string]interface{}{"sub": "admin"}))
+	tampered := parts[0] + "." + b64(payload) + "." + parts[2]
+	tests := []struct {
+		name, token, principal string
+		ok                     bool
+	}{
+		{"RS256", signJwt(t, "RS256", "rsa", rsaKey, claims(nil)), "billing", true},
+		{"RS512", signJwt(t, "RS512", "rsa", rsaKey, claims(nil)), "billing", true},
+		{"ES256", signJwt(t, "ES256", "ec", ecKey, claims(nil)), "billing", true},
+		{"audience in a list", signJwt(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"aud": []string{"other", "director"}})), "billing", true},
+		{"expired within the leeway", signJwt(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"exp": now - 10})), "billing", true},
+		{"not a JWT", "static-token", "", true},
+		{"expired", signJwt(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"exp": now - 60})), "", false},
+		{"no expiration", signJwt(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"exp": nil})), "", false},
+		{"not valid yet", signJwt(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"nbf": now + 60})), "", false},
+		{"another issuer", signJwt(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"iss": "https://evil"})), "", false},
+		{"another audience", signJwt(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"aud": []string{"other"}})), "", false},
+		{"no subject", signJwt(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"sub": nil})), "", false},
+		{"unknown key", signJwt(t, "ES256", "other", ecKey, claims(nil)), "", false},
+		{"encryption key", signJwt(t, "ES256", "enc", otherKey, claims(nil)), "", false},
+		{"signed by another key", signJwt(t, "ES256", "ec", otherKey, claims(nil)), "", false},
+		{"algorithm of another key type", signJwt(t, "ES256", "rsa", ecKey, claims(nil)), "", false},
+		{"curve of another size", signJwt(t, "ES384", "ec", ecKey, claims(nil)), "", false},
+		{"unsupported algorithm", signJwt(t, "HS256", "rsa", rsaKey, claims(nil)), "", false},
+		{"unsupported key type", signJwt(t, "RS256", "ed", rsaKey, claims(nil)), "", false},
+		{"tampered claims", tampered, "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/director/services/types", nil)
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		principal, err := a.Authenticate(r)
+		if (err == nil) != tt.ok || principal != tt.principal {
+			t.Errorf("%s: '%s', %v, want '%s'", tt.name, principal, err, tt.principal)
+		}
+	}
+}
+
+func TestJwksKeyTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name string
+		key  map[string]string
+		ok   bool
+	}{
+		{"RSA", map[string]string{"kty": "RSA", "kid": "k", "n": "AQAB", "e": "AQAB"}, true},
+		{"OKP", map[string]string{"kty": "OKP", "kid": "k", "crv": "Ed25519", "x": "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}, false},
+		{"unknown curve", map[string]string{"kty": "EC", "kid": "k", "crv": "P-192", "x": "AQAB", "y": "AQAB"}, false},
+		{"point not on curve", map[string]string{"kty": "EC", "kid": "k", "crv": "P-256", "x": "AQAB", "y": "AQAB"}, false},
+	}
+	for _, tt := range tests {
+		jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{tt.key}})
+		path := filepath.Join(dir, "jwks.json")
+		if err := ioutil.WriteFile(path, jwks, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewJwtAuth(path, "", ""); (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
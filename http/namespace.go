@@ -0,0 +1,155 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"git.reaxoft.loc/infomir/director/dnsgate"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+)
+
+// A zone managed by the director with its own DNS server and key. The services of the namespace
+// are served under "<root>/<name>", e.g. "/director/stage/services/...". The fields mean the same
+// as the --dns-* and --store options of the default namespace.
+type Namespace struct {
+	Domain     string `json:"domain"`
+	DnsBackend string `json:"dns_backend"`
+	DnsListen  string `json:"dns_listen"`
+	DnsServer  string `json:"dns_s"`
+	DnsNet     string `json:"dns_net"`
+	DnsTlsCa   string `json:"dns_tls_ca"`
+	DnsUdpSize uint16 `json:"dns_udp_size"`
+	DnsPk      string `json:"dns_pk"`
+	DnsTsig    string `json:"dns_tsig"`
+	Store      string `json:"store"`
+}
+
+// Path segments of the routes, namespaces must not shadow them.
+var reservedNsNames = map[string]bool{"services": true, "leases": true, "watch": true}
+
+// Loads the namespaces file, a JSON object of namespaces by their names, e.g.:
+//
+//	{
+//	  "stage": {"domain": "stage.cust.rxt", "dns_s": "172.25.0.161:53", "dns_tsig": "/etc/director/stage.tsig"},
+//	  "dev": {"domain": "dev.cust.rxt", "dns_backend": "embedded", "dns_listen": ":5353"}
+//	}
+//
+// The embedded DNS servers of the namespaces may not listen on the same address, nor on listen,
+// the address of the default embedded server ("" if it has none).
+func LoadNamespaces(path string, listen string) (map[string]*Namespace, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var nss map[string]*Namespace
+	if err := json.Unmarshal(b, &nss); err != nil {
+		return nil, fmt.Errorf("bad namespaces file '%s': %s", path, err.Error())
+	}
+	names := make([]string, 0, len(nss))
+	for name := range nss {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []string
+	// the taken addresses and who listens on them
+	type listener struct{ addr, by string }
+	var listeners []listener
+	if listen != "" {
+		listeners = append(listeners, listener{listen, "--dns-listen"})
+	}
+	for _, name := range names {
+		if err := nss[name].validate(name); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if nss[name].DnsBackend != DnsBackendEmbedded {
+			continue
+		}
+		for _, l := range listeners {
+			if sameListenAddr(l.addr, nss[name].DnsListen) {
+				errs = append(errs, fmt.Sprintf("namespace '%s' listens on '%s' like %s", name, nss[name].DnsListen, l.by))
+			}
+		}
+		listeners = append(listeners, listener{nss[name].DnsListen, fmt.Sprintf("namespace '%s'", name)})
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("bad namespaces file '%s': %s", path, strings.Join(errs, "; "))
+	}
+	return nss, nil
+}
+
+// Tells whether the listen addresses overlap: their ports are the same, and so are their hosts or
+// one of them is any address.
+func sameListenAddr(a, b string) bool {
+	ahost, aport, aerr := net.SplitHostPort(a)
+	bhost, bport, berr := net.SplitHostPort(b)
+	if aerr != nil || berr != nil {
+		return a == b
+	}
+	if aport != bport {
+		return false
+	}
+	anyHost := func(host string) bool {
+		ip := net.ParseIP(host)
+		return host == "" || ip != nil && ip.IsUnspecified()
+	}
+	return anyHost(ahost) || anyHost(bhost) || strings.EqualFold(ahost, bhost)
+}
+
+// Validates the namespace and fills in the defaults.
+func (ns *Namespace) validate(name string) error {
+	if ns == nil {
+		return fmt.Errorf("namespace '%s' is empty", name)
+	}
+	if name == "" || reservedNsNames[name] || strings.ContainsAny(name, "/:*.") {
+		return fmt.Errorf("'%s' is not allowed as a namespace name", name)
+	}
+	if ns.Domain == "" {
+		return fmt.Errorf("namespace '%s' has no domain", name)
+	}
+	if ns.DnsBackend == "" {
+		ns.DnsBackend = DnsBackendRemote
+	}
+	if ns.DnsNet == "" {
+		ns.DnsNet = dnsgate.NetUdp
+	}
+	if ns.DnsListen == "" {
+		ns.DnsListen = ":53"
+	}
+	switch ns.DnsBackend {
+	case DnsBackendRemote:
+		if ns.DnsServer == "" {
+			return fmt.Errorf("namespace '%s' has no dns_s", name)
+		}
+		if ns.DnsPk == "" && ns.DnsTsig == "" {
+			return fmt.Errorf("namespace '%s' has neither dns_pk nor dns_tsig", name)
+		}
+	case DnsBackendMemory, DnsBackendEmbedded:
+	default:
+		return fmt.Errorf("dns_backend of namespace '%s' must be one of remote, memory, embedded", name)
+	}
+	switch ns.DnsNet {
+	case dnsgate.NetUdp, dnsgate.NetTcp, dnsgate.NetTls:
+	default:
+		return fmt.Errorf("dns_net of namespace '%s' must be one of udp, tcp, tls", name)
+	}
+	return nil
+}
+
+// Returns the default namespace served under the root, as given by the options.
+func (ds *DirectorServer) defaultNamespace() *Namespace {
+	return &Namespace{
+		Domain:     ds.domain,
+		DnsBackend: ds.dnsbackend,
+		DnsListen:  ds.dnslisten,
+		DnsServer:  ds.dnsserver,
+		DnsNet:     ds.dnsnet,
+		DnsTlsCa:   ds.dnstlsca,
+		DnsUdpSize: ds.dnsudpsize,
+		DnsPk:      ds.dnspk,
+		DnsTsig:    ds.dnstsig,
+		Store:      ds.storepath,
+	}
+}
@@ -0,0 +1,58 @@
+package http
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadNamespacesListen(t *testing.T) {
+	tests := []struct {
+		name, nss, listen, err string
+	}{
+		{"distinct addresses",
+			`{"a": {"domain": "a.cust.rxt", "dns_backend": "embedded", "dns_listen": ":5353"},
+			  "b": {"domain": "b.cust.rxt", "dns_backend": "embedded", "dns_listen": ":5354"}}`, ":53", ""},
+		{"same address",
+			`{"a": {"domain": "a.cust.rxt", "dns_backend": "embedded", "dns_listen": ":5353"},
+			  "b": {"domain": "b.cust.rxt", "dns_backend": "embedded", "dns_listen": ":5353"}}`, "",
+			"namespace 'b' listens on ':5353' like namespace 'a'"},
+		{"any address overlaps a host",
+			`{"a": {"domain": "a.cust.rxt", "dns_backend": "embedded", "dns_listen": "127.0.0.1:5353"},
+			  "b": {"domain": "b.cust.rxt", "dns_backend": "embedded", "dns_listen": "0.0.0.0:5353"}}`, "",
+			"namespace 'b' listens on '0.0.0.0:5353' like namespace 'a'"},
+		{"different hosts",
+			`{"a": {"domain": "a.cust.rxt", "dns_backend": "embedded", "dns_listen": "127.0.0.1:5353"},
+			  "b": {"domain": "b.cust.rxt", "dns_backend": "embedded", "dns_listen": "127.0.0.2:5353"}}`, "", ""},
+		{"default listen of the default server",
+			`{"a": {"domain": "a.cust.rxt", "dns_backend": "embedded"}}`, ":53",
+			"namespace 'a' listens on ':53' like --dns-listen"},
+		{"default server is not embedded",
+			`{"a": {"domain": "a.cust.rxt", "dns_backend": "embedded"}}`, "", ""},
+		{"only embedded namespaces listen",
+			`{"a": {"domain": "a.cust.rxt", "dns_backend": "memory"},
+			  "b": {"domain": "b.cust.rxt", "dns_backend": "embedded"}}`, "", ""},
+	}
+	dir, err := ioutil.TempDir("", "namespaces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tt := range tests {
+		path := filepath.Join(dir, "namespaces.json")
+		if err := ioutil.WriteFile(path, []byte(tt.nss), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadNamespaces(path, tt.listen)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+		case tt.err != "" && err == nil:
+			t.Errorf("%s: no error, want '%s'", tt.name, tt.err)
+		case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+			t.Errorf("%s: error '%s', want '%s'", tt.name, err, tt.err)
+		}
+	}
+}
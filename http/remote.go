@@ -0,0 +1,91 @@
+package http
+
+import (
+	"git.reaxoft.loc/infomir/director/core"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Parses comma separated CIDRs, a single address stands for itself.
+func ParseNets(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: p}
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (ds *DirectorServer) isTrustedProxy(ip net.IP) bool {
+	for _, n := range ds.trustedproxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the address of the client. X-Forwarded-For is honored only if the request comes from a trusted proxy:
+// addresses are taken from right to left while they are trusted proxies, the first other one is the client.
+func (ds *DirectorServer) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ds.isTrustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !ds.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// Makes the client the server of the service if the server is omitted: the host name is synthesized
+// from the client address and the address is added to the addresses of the service.
+func (ds *DirectorServer) fillServer(dr *director.Director, srv *director.DnsService, r *http.Request) error {
+	if srv.Server != "" {
+		return nil
+	}
+	ip := ds.clientIP(r)
+	if ip == nil {
+		return &ServerError{http.StatusBadRequest, ErrBadRequest, "Server is omitted and the client address is unknown"}
+	}
+	srv.Server = dr.AddressHost(ip)
+	for _, a := range srv.Addresses {
+		if net.ParseIP(a).Equal(ip) {
+			return nil
+		}
+	}
+	srv.Addresses = append(srv.Addresses, ip.String())
+	return nil
+}
@@ -0,0 +1,97 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCreateReportsInstance(t *testing.T) {
+	tests := []struct {
+		name, body, location string
+	}{
+		{"server given", `{"name": "bo1._bo._rest_http._tcp.cust.rxt", "server": "h1.cust.rxt", "port": 80}`,
+			"/director/services/instances/bo1._bo._rest_http._tcp.cust.rxt?port=80&server=h1.cust.rxt"},
+		{"server of the client", `{"name": "bo1._bo._rest_http._tcp.cust.rxt", "port": 80}`,
+			"/director/services/instances/bo1._bo._rest_http._tcp.cust.rxt?port=80&server=ip-10-1-2-3.cust.rxt."},
+		{"server of the client with a lease", `{"name": "bo1._bo._rest_http._tcp.cust.rxt", "port": 81, "lease_ttl": 30}`,
+			"/director/services/instances/bo1._bo._rest_http._tcp.cust.rxt?port=81&server=ip-10-1-2-3.cust.rxt."},
+	}
+	_, _, h := newTestServer(nil)
+	for _, tt := range tests {
+		r := httptest.NewRequest("PUT", "/director/services/_bo._rest_http._tcp.cust.rxt", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", "application/json")
+		r.RemoteAddr = "10.1.2.3:40000"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s: status %d: %s", tt.name, w.Code, w.Body.String())
+		}
+		if loc := w.Header().Get("Location"); loc != tt.location {
+			t.Errorf("%s: Location %s, want %s", tt.name, loc, tt.location)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	nets, err := ParseNets("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := &DirectorServer{trustedproxies: nets}
+	tests := []struct {
+		name, remote string
+		xff          []string
+		ip           string
+	}{
+		{"no proxy", "172.16.0.1:40000", nil, "172.16.0.1"},
+		{"untrusted peer is not believed", "172.16.0.1:40000", []string{"1.2.3.4"}, "172.16.0.1"},
+		{"trusted proxy", "10.0.0.1:40000", []string{"1.2.3.4"}, "1.2.3.4"},
+		{"single trusted address", "192.168.1.1:40000", []string{"1.2.3.4"}, "1.2.3.4"},
+		{"address next to the trusted one", "192.168.1.2:40000", []string{"1.2.3.4"}, "192.168.1.2"},
+		{"spoofed hops left of the client", "10.0.0.1:40000", []string{"6.6.6.6, 1.2.3.4, 10.0.0.2"}, "1.2.3.4"},
+		{"hops in several headers", "10.0.0.1:40000", []string{"6.6.6.6, 1.2.3.4", "10.0.0.2"}, "1.2.3.4"},
+		{"trusted proxy without the header", "10.0.0.1:40000", nil, "10.0.0.1"},
+		{"bad hop", "10.0.0.1:40000", []string{"1.2.3.4, bad"}, "10.0.0.1"},
+		{"IPv6 client", "10.0.0.1:40000", []string{"fd00::1"}, "fd00::1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/director/services/types", nil)
+		r.RemoteAddr = tt.remote
+		for _, v := range tt.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if ip := ds.clientIP(r); ip.String() != tt.ip {
+			t.Errorf("%s: %s, want %s", tt.name, ip, tt.ip)
+		}
+	}
+}
+
+func TestParseNets(t *testing.T) {
+	tests := []struct {
+		s    string
+		nets string
+		ok   bool
+	}{
+		{"10.0.0.0/8,fd00::/8", "10.0.0.0/8 fd00::/8", true},
+		{" 10.0.0.1 , ::1,", "10.0.0.1/32 ::1/128", true},
+		{"", "", true},
+		{"10.0.0.0/33", "", false},
+		{"10.0.0.256", "", false},
+	}
+	for _, tt := range tests {
+		nets, err := ParseNets(tt.s)
+		if (err == nil) != tt.ok {
+			t.Errorf("'%s': %v", tt.s, err)
+			continue
+		}
+		var strs []string
+		for _, n := range nets {
+			strs = append(strs, n.String())
+		}
+		if got := strings.Join(strs, " "); got != tt.nets {
+			t.Errorf("'%s': %s, want %s", tt.s, got, tt.nets)
+		}
+	}
+}
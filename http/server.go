@@ -2,24 +2,38 @@ package http
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"git.reaxoft.loc/infomir/director/core"
+	"git.reaxoft.loc/infomir/director/dnsgate"
 	"git.reaxoft.loc/infomir/director/logger"
 	"github.com/julienschmidt/httprouter"
 	"io"
 	"log"
 	"mime"
+	"net"
 	"net/http"
 	"net/textproto"
 	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
+// Backends to keep DNS records in.
+const (
+	DnsBackendRemote   = "remote"
+	DnsBackendMemory   = "memory"
+	DnsBackendEmbedded = "embedded"
+)
+
+// The SIG(0) key used when --dns-pk is not given, the embedded backend runs without it if it is missing.
+const DefaultDnsPk = "./dns.private"
+
 const (
 	ErrUnsupportedMediaType = "unsupported_media_type"
 	ErrBadRequest           = "bad_request"
@@ -43,17 +57,30 @@ func (e *ServerError) Json() []byte {
 type DirectorServer struct {
 	addr, root, domain     string
 	port                   uint16
+	dnsbackend, dnslisten  string
 	dnsserver, dnspk       string
+	dnsnet, dnstlsca       string
+	dnstsig                string
+	dnsudpsize             uint16
+	storepath              string
+	leasettl               uint32
+	trustedproxies         []*net.IPNet
+	auth                   *Auth
+	namespaces             map[string]*Namespace
+	tlscert, tlskey        string
+	tlsclientca            string
 	srvhostname            string
 	srvttl                 uint32
 	srvpriority, srvweight uint16
 	srvtype                string
+	srvtypeprefix          string
+	srvinfos               []*srvinfo
 	basepath               string
 	s                      *http.Server
 }
 
 func NewServer(a string, p uint16, hostname string, r, d, ds, dpk string) *DirectorServer {
-	return &DirectorServer{addr: a, port: p, root: r, domain: d, dnsserver: ds, dnspk: dpk, srvhostname: hostname}
+	return &DirectorServer{addr: a, port: p, root: r, domain: d, dnsserver: ds, dnspk: dpk, srvhostname: hostname, srvtypeprefix: DefaultSrvTypePrefix, srvinfos: services, dnsbackend: DnsBackendRemote, dnslisten: ":53", dnsnet: dnsgate.NetUdp}
 }
 
 func (ds *DirectorServer) SetAddr(a string) {
@@ -72,6 +99,14 @@ func (ds *DirectorServer) SetDomain(d string) {
 	ds.domain = d
 }
 
+func (ds *DirectorServer) SetDnsBackend(b string) {
+	ds.dnsbackend = b
+}
+
+func (ds *DirectorServer) SetDnsListen(addr string) {
+	ds.dnslisten = addr
+}
+
 func (ds *DirectorServer) SetDnsServer(s string) {
 	ds.dnsserver = s
 }
@@ -80,6 +115,58 @@ func (ds *DirectorServer) SetDnsPk(pk string) {
 	ds.dnspk = pk
 }
 
+func (ds *DirectorServer) SetDnsTsig(keyfile string) {
+	ds.dnstsig = keyfile
+}
+
+func (ds *DirectorServer) SetDnsNet(n string) {
+	ds.dnsnet = n
+}
+
+func (ds *DirectorServer) SetDnsTlsCa(ca string) {
+	ds.dnstlsca = ca
+}
+
+func (ds *DirectorServer) SetDnsUdpSize(size uint16) {
+	ds.dnsudpsize = size
+}
+
+func (ds *DirectorServer) SetStore(path string) {
+	ds.storepath = path
+}
+
+// Sets the lease duration in seconds given to registrations which do not request one, zero means no lease.
+func (ds *DirectorServer) SetLeaseTtl(ttl uint32) {
+	ds.leasettl = ttl
+}
+
+// Sets the networks of proxies whose X-Forwarded-For header tells the client address.
+func (ds *DirectorServer) SetTrustedProxies(nets []*net.IPNet) {
+	ds.trustedproxies = nets
+}
+
+// Sets authentication and authorization of the mutating routes, nil lets anyone change anything.
+func (ds *DirectorServer) SetAuth(a *Auth) {
+	ds.auth = a
+}
+
+// Serves HTTPS with the certificate and the key, both are loaded again on SIGHUP.
+func (ds *DirectorServer) SetTls(cert, key string) {
+	ds.tlscert, ds.tlskey = cert, key
+}
+
+// Sets the CA bundle to verify client certificates with. Without auth every client must present
+// a certificate and may change only the instances on its own hosts, otherwise a certificate is
+// one more way to authenticate.
+func (ds *DirectorServer) SetTlsClientCa(ca string) {
+	ds.tlsclientca = ca
+}
+
+// Sets the namespaces served besides the default one under the root.
+func (ds *DirectorServer) SetNamespaces(nss map[string]*Namespace) {
+	ds.namespaces = nss
+}
+
 func (ds *DirectorServer) SetSrvHostname(hostname string) {
 	ds.srvhostname = hostname
 }
@@ -96,6 +183,44 @@ func (ds *DirectorServer) SetSrvWeight(weight uint16) {
 	ds.srvweight = weight
 }
 
+// Sets the type of director's own services without the domain, e.g. "_drt._rest_http".
+func (ds *DirectorServer) SetSrvTypePrefix(prefix string) {
+	ds.srvtypeprefix = strings.Trim(prefix, ".")
+}
+
+// Sets director's own services by comma separated "name:METHOD:path" entries, the path is relative
+// to "<root>/services", e.g. "reg_srv:PUT:,get_srvs:GET:/types".
+func (ds *DirectorServer) SetSrvServices(spec string) error {
+	var infos []*srvinfo
+	names := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		if len(parts) != 3 {
+			return fmt.Errorf("service '%s' is not of 'name:METHOD:path' form", entry)
+		}
+		name, method, path := parts[0], strings.ToUpper(parts[1]), parts[2]
+		if name == "" || strings.HasPrefix(name, "_") || strings.Contains(name, ".") {
+			return fmt.Errorf("service name '%s' must be one label not starting with '_'", name)
+		}
+		if names[name] {
+			return fmt.Errorf("service '%s' is given more than once", name)
+		}
+		names[name] = true
+		if method == "" {
+			return fmt.Errorf("service '%s' has no method", name)
+		}
+		if path != "" && !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("path '%s' of service '%s' must start with '/'", path, name)
+		}
+		infos = append(infos, &srvinfo{name + ".", method, path})
+	}
+	ds.srvinfos = infos
+	return nil
+}
+
+// The type prefix of director's own services.
+const DefaultSrvTypePrefix = "_drt._rest_http"
+
 type srvinfo struct {
 	name, method, path string
 }
@@ -103,9 +228,9 @@ type srvinfo struct {
 var services = []*srvinfo{
 	&srvinfo{"reg_srv.", "PUT", ""},
 	&srvinfo{"get_srvs.", "GET", "/types"},
-	&srvinfo{"get_ins.", "GET", "/intances"},
+	&srvinfo{"get_ins.", "GET", "/instances"},
 	&srvinfo{"del_srv.", "DELETE", "/types"},
-	&srvinfo{"del_ins.", "DELETE", "/names"},
+	&srvinfo{"del_ins.", "DELETE", "/instances"},
 }
 
 func (ds *DirectorServer) newService(info *srvinfo) *director.DnsService {
@@ -121,18 +246,18 @@ func (ds *DirectorServer) newService(info *srvinfo) *director.DnsService {
 }
 
 func (ds *DirectorServer) regDnsServices(dr *director.Director) error {
-	ds.srvtype = "_drt._rest_http." + ds.domain
+	ds.srvtype = ds.srvtypeprefix + "." + ds.domain
 	ds.basepath = ds.root + "/services"
-	for _, si := range services {
-		if e := dr.RegDnsSrv(ds.srvtype, ds.newService(si)); e != nil {
-			return e
-		}
+	batch := make([]*director.Registration, len(ds.srvinfos))
+	for i, si := range ds.srvinfos {
+		batch[i] = &director.Registration{Type: ds.srvtype, DnsService: *ds.newService(si)}
 	}
-	return nil
+	_, e := dr.RegDnsSrvBatch(batch)
+	return e
 }
 
 func (ds *DirectorServer) delDnsServices(dr *director.Director) error {
-	for _, si := range services {
+	for _, si := range ds.srvinfos {
 		if e := dr.RmInstance(si.name+ds.srvtype, ds.srvhostname, ds.port); e != nil {
 			return e
 		}
@@ -140,6 +265,59 @@ func (ds *DirectorServer) delDnsServices(dr *director.Director) error {
 	return nil
 }
 
+func (ds *DirectorServer) newDirector(ns *Namespace) (*director.Director, error) {
+	switch ns.DnsBackend {
+	case DnsBackendMemory:
+		logger.Warn("DNS records of '%s' are kept in memory only and are not published to any DNS server", ns.Domain)
+		return director.NewDirectorWithGate(ns.Domain, dnsgate.NewMemDnsGate()), nil
+	case DnsBackendEmbedded:
+		gc := &dnsgate.Config{KeyPath: ns.DnsPk, TsigKeyPath: ns.DnsTsig}
+		if _, err := os.Stat(ns.DnsPk); err != nil && ns.DnsPk == DefaultDnsPk {
+			gc.KeyPath = ""
+		}
+		dg, err := dnsgate.NewEmbeddedDnsGate(ns.Domain, ds.srvhostname, ns.DnsListen, gc)
+		if err != nil {
+			return nil, err
+		}
+		return director.NewDirectorWithGate(ns.Domain, dg), nil
+	}
+
+	gc := &dnsgate.Config{Net: ns.DnsNet, KeyPath: ns.DnsPk, TsigKeyPath: ns.DnsTsig, UdpSize: ns.DnsUdpSize}
+	if ns.DnsNet == dnsgate.NetTls {
+		tc, err := dnsgate.NewTlsConfig(ns.DnsTlsCa)
+		if err != nil {
+			logger.Error("Failed to load DNS TLS configuration: %s", err.Error())
+			return nil, err
+		}
+		gc.TlsConfig = tc
+	}
+	return director.NewDirector(ns.Domain, ns.DnsServer, gc)
+}
+
+//Creates the director of the namespace, pushes its stored registrations to DNS and starts expiring its leases.
+func (ds *DirectorServer) openDirector(ns *Namespace) *director.Director {
+	dr, err := ds.newDirector(ns)
+	if err != nil {
+		logger.Error("Failed to create connection pool: %s", err.Error())
+		panic(err)
+	}
+	if ns.Store != "" {
+		if err := dr.OpenStore(ns.Store); err != nil {
+			logger.Error("Failed to open store: %s", err.Error())
+			panic(err)
+		}
+		logger.Info("Reconciling DNS with the registrations in '%s' ...", ns.Store)
+		if n, err := dr.Reconcile(); err != nil {
+			logger.Error("Reconciliation failed: %s", err.Error())
+		} else {
+			logger.Info("%d registrations have been pushed to DNS again", n)
+		}
+	}
+
+	dr.StartReaper(time.Second)
+	return dr
+}
+
 func getMandatoryQParam(q url.Values, name string) (string, error) {
 	v := q.Get(name)
 	if v == "" {
@@ -149,81 +327,319 @@ func getMandatoryQParam(q url.Values, name string) (string, error) {
 	}
 }
 
+const (
+	defaultWatchWait = 30 * time.Second
+	maxWatchWait     = 50 * time.Second
+)
+
+type watchFunc func(ctx context.Context, key string, index uint64) ([]*director.Event, uint64, error)
+
+//Long-polls the events of the key from the 'index' query parameter for 'wait' seconds at most.
+func createWatchAction(param string, watch watchFunc) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		sink, _ := asJsonSink(w)
+		q := r.URL.Query()
+		var index uint64
+		if v := q.Get("index"); v != "" {
+			i, e := strconv.ParseUint(v, 10, 64)
+			if e != nil {
+				sink.pushError(&ServerError{http.StatusBadRequest, ErrBadRequest, "Query parameter 'index' must be a number"})
+				return
+			}
+			index = i
+		}
+		wait := defaultWatchWait
+		if v := q.Get("wait"); v != "" {
+			sec, e := strconv.ParseUint(v, 10, 16)
+			if e != nil {
+				sink.pushError(&ServerError{http.StatusBadRequest, ErrBadRequest, "Query parameter 'wait' must be a number of seconds"})
+				return
+			}
+			wait = time.Duration(sec) * time.Second
+			if wait > maxWatchWait {
+				wait = maxWatchWait
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		events, index, e := watch(ctx, p.ByName(param), index)
+		if e != nil {
+			sink.pushError(e)
+			return
+		}
+		if events == nil {
+			events = []*director.Event{}
+		}
+		sink.push(map[string]interface{}{"index": index, "events": events})
+	}
+}
+
+//Converts conditional request headers into the registration condition:
+//'If-None-Match: *' registers only a new service name, 'If-Match: <ETag>' only an unchanged one.
+func regCondOf(h http.Header) *director.RegCond {
+	var cond *director.RegCond
+	if h.Get("If-None-Match") == "*" {
+		cond = &director.RegCond{IfAbsent: true}
+	}
+	if tag := h.Get("If-Match"); tag != "" {
+		if cond == nil {
+			cond = &director.RegCond{}
+		}
+		cond.IfMatch = tag
+	}
+	return cond
+}
+
 func (ds *DirectorServer) Run() {
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-	dr, err := director.NewDirector(ds.domain, ds.dnsserver, ds.dnspk)
-	if err != nil {
-		logger.Error("Failed to create connection pool: %s", err.Error())
-		panic(err)
+	clientauth := tls.VerifyClientCertIfGiven
+	if ds.tlscert != "" && ds.tlsclientca != "" && ds.auth == nil {
+		clientauth = tls.RequireAndVerifyClientCert
+		ds.auth = newSelfAuth()
 	}
-
+	dr := ds.openDirector(ds.defaultNamespace())
 	router := httprouter.New()
+	ds.route(router, ds.root, dr)
+	nsdrs := make(map[string]*director.Director, len(ds.namespaces))
+	for name, ns := range ds.namespaces {
+		logger.Info("Opening namespace '%s' of domain '%s' ...", name, ns.Domain)
+		nsdrs[name] = ds.openDirector(ns)
+		ds.route(router, ds.root+"/"+name, nsdrs[name])
+	}
 
-	router.PUT(ds.root+"/services/:type", CreateDualJsonAction(func(src *json.Decoder, sink *JsonSink, p httprouter.Params, q url.Values) {
-		var ds director.DnsService
-		if e := src.Decode(&ds); e != nil {
-			logger.Error("Can't decode JSON to object: %s", e.Error())
-			sink.pushError(&ServerError{http.StatusBadRequest, ErrBadRequest, "bad JSON: " + e.Error()})
-			return
+	ds.s = &http.Server{
+		Addr:           ds.addr + ":" + strconv.FormatUint(uint64(ds.port), 10),
+		Handler:        router,
+		ReadTimeout:    60 * time.Second,
+		WriteTimeout:   60 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	var tf *tlsFiles
+	if ds.tlscert != "" {
+		tf = &tlsFiles{cert: ds.tlscert, key: ds.tlskey, clientca: ds.tlsclientca, clientauth: clientauth}
+		if err := tf.load(); err != nil {
+			logger.Error("Failed to load TLS certificates: %s", err.Error())
+			panic(err)
 		}
+		ds.s.TLSConfig = tf.tlsConfig()
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				reloadTls(tf)
+			}
+		}()
+	}
 
-		if e := dr.RegDnsSrv(p.ByName("type"), &ds); e != nil {
-			sink.pushError(e)
+	logger.Info("Registring director's services in DNS ...")
+	if e := ds.regDnsServices(dr); e != nil {
+		logger.Error("Filed to registring service: %s", e.Error())
+		log.Fatal(e)
+	}
+	logger.Info("Director's services has been registered")
+
+	go func() {
+		var err error
+		if tf != nil {
+			logger.Info("Director server listening on https://%s%s", ds.s.Addr, ds.root)
+			err = ds.s.ListenAndServeTLS("", "")
 		} else {
-			sink.pushCreated()
+			logger.Info("Director server listening on http://%s%s", ds.s.Addr, ds.root)
+			err = ds.s.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			logger.Error("Director server listening and serve failed: %s", err.Error())
+			log.Fatal(err)
 		}
+	}()
+
+	<-stop
+
+	logger.Info("Deleting director's instances of services in DNS ...")
+	if e := ds.delDnsServices(dr); e != nil {
+		logger.Error("Failed director's instances of services in DNS: %s", e.Error())
+	} else {
+		logger.Info("Director's instances of services has been deleted")
+	}
+
+	logger.Info("Shutting down Director server with %ds timeout ...", 10)
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	ds.s.Shutdown(ctx)
+	dr.Shutdown()
+	for _, nsdr := range nsdrs {
+		nsdr.Shutdown()
+	}
+	logger.Info("Directory server gracefully stopped")
+}
+
+//Returns the URL path of the registered instance, the server may have been filled in from the request.
+func instanceLocation(base string, srv *director.DnsService) string {
+	q := url.Values{"server": {srv.Server}, "port": {strconv.FormatUint(uint64(srv.Port), 10)}}
+	return base + "/services/instances/" + url.PathEscape(srv.Name) + "?" + q.Encode()
+}
+
+//Registers the routes of the director under base.
+func (ds *DirectorServer) route(router *httprouter.Router, base string, dr *director.Director) {
+	router.PUT(base+"/services/:type", ds.secured(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		cond := regCondOf(r.Header)
+		CreateDualJsonAction(func(src *json.Decoder, sink *JsonSink, p httprouter.Params, q url.Values) {
+			var srv director.DnsService
+			if e := src.Decode(&srv); e != nil {
+				logger.Error("Can't decode JSON to object: %s", e.Error())
+				sink.pushError(&ServerError{http.StatusBadRequest, ErrBadRequest, "bad JSON: " + e.Error()})
+				return
+			}
+
+			if e := ds.fillServer(dr, &srv, r); e != nil {
+				sink.pushError(e)
+				return
+			}
+			if e := ds.authorize(r, p.ByName("type"), srv.Name, srv.Server); e != nil {
+				sink.pushError(e)
+				return
+			}
+			if srv.LeaseTtl == 0 {
+				srv.LeaseTtl = ds.leasettl
+			}
+			lease, e := dr.RegDnsSrvIf(p.ByName("type"), &srv, cond)
+			if e != nil {
+				sink.pushError(e)
+				return
+			}
+			sink.setHeader("Location", instanceLocation(base, &srv))
+			if lease != nil {
+				sink.pushCreatedObj(lease)
+			} else {
+				sink.pushCreated()
+			}
+		})(w, r, p)
 	}))
 
-	router.GET(ds.root+"/services/types/:type", CreateJsonAction(func(_ io.ReadCloser, sink *JsonSink, p httprouter.Params, q url.Values) {
-		if names, e := dr.FindDnsSrvNames(p.ByName("type")); e != nil {
+	router.POST(base+"/services/batch", ds.secured(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		CreateDualJsonAction(func(src *json.Decoder, sink *JsonSink, p httprouter.Params, q url.Values) {
+			var batch []*director.Registration
+			if e := src.Decode(&batch); e != nil {
+				logger.Error("Can't decode JSON to object: %s", e.Error())
+				sink.pushError(&ServerError{http.StatusBadRequest, ErrBadRequest, "bad JSON: " + e.Error()})
+				return
+			}
+
+			for _, reg := range batch {
+				if reg == nil {
+					continue
+				}
+				if e := ds.fillServer(dr, &reg.DnsService, r); e != nil {
+					sink.pushError(e)
+					return
+				}
+				if e := ds.authorize(r, reg.Type, reg.Name, reg.Server); e != nil {
+					sink.pushError(e)
+					return
+				}
+				if reg.LeaseTtl == 0 {
+					reg.LeaseTtl = ds.leasettl
+				}
+			}
+			if leases, e := dr.RegDnsSrvBatch(batch); e != nil {
+				sink.pushError(e)
+			} else {
+				sink.pushCreatedObj(leases)
+			}
+		})(w, r, p)
+	}))
+
+	router.PUT(base+"/leases/:id/heartbeat", ds.secured(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		CreateJsonAction(func(_ io.ReadCloser, sink *JsonSink, p httprouter.Params, q url.Values) {
+			name, server, e := dr.LeaseInstance(p.ByName("id"))
+			if e != nil {
+				sink.pushError(e)
+				return
+			}
+			if e := ds.authorize(r, typeOfName(name), name, server); e != nil {
+				sink.pushError(e)
+				return
+			}
+			if lease, e := dr.RenewLease(p.ByName("id")); e != nil {
+				sink.pushError(e)
+			} else {
+				sink.push(lease)
+			}
+		})(w, r, p)
+	}))
+
+	router.GET(base+"/services/types", CreateJsonAction(func(_ io.ReadCloser, sink *JsonSink, p httprouter.Params, q url.Values) {
+		if types, e := dr.FindDnsSrvTypes(); e != nil {
 			sink.pushError(e)
 		} else {
-			sink.push(names)
+			sink.push(types)
 		}
 	}))
 
-	router.GET(ds.root+"/services/instances/:name", CreateJsonAction(func(_ io.ReadCloser, sink *JsonSink, p httprouter.Params, q url.Values) {
-		if instances, e := dr.FindDnsSrvInstances(p.ByName("name")); e != nil {
+	router.GET(base+"/services/types/:type", CreateJsonAction(func(_ io.ReadCloser, sink *JsonSink, p httprouter.Params, q url.Values) {
+		if names, e := dr.FindDnsSrvNames(p.ByName("type")); e != nil {
 			sink.pushError(e)
 		} else {
-			sink.push(instances)
+			sink.push(names)
 		}
 	}))
 
-	router.DELETE(ds.root+"/services/types/:type", CreateJsonAction(func(_ io.ReadCloser, sink *JsonSink, p httprouter.Params, q url.Values) {
-		name, err := getMandatoryQParam(q, "name")
-		if err != nil {
-			logger.Error(err.Error())
-			sink.pushError(err)
+	router.GET(base+"/services/instances/:name", CreateJsonAction(func(_ io.ReadCloser, sink *JsonSink, p httprouter.Params, q url.Values) {
+		instances, e := dr.FindDnsSrvInstances(p.ByName("name"))
+		if e != nil {
+			sink.pushError(e)
 			return
 		}
-
-		if e := dr.RmDnsSrv(p.ByName("type"), name); e != nil {
-			sink.pushError(e)
-		} else {
-			sink.pushEmpty()
+		if tag, e := dr.SrvTag(p.ByName("name")); e == nil {
+			sink.setHeader("ETag", tag)
 		}
+		sink.push(instances)
+	}))
+
+	router.GET(base+"/watch/types/:type", createWatchAction("type", dr.WatchSrvType))
+
+	router.GET(base+"/watch/instances/:name", createWatchAction("name", dr.WatchSrvName))
+
+	router.DELETE(base+"/services/types/:type", ds.secured(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		CreateJsonAction(func(_ io.ReadCloser, sink *JsonSink, p httprouter.Params, q url.Values) {
+			name, err := getMandatoryQParam(q, "name")
+			if err != nil {
+				logger.Error("%s", err.Error())
+				sink.pushError(err)
+				return
+			}
+			if e := ds.authorize(r, p.ByName("type"), name, ""); e != nil {
+				sink.pushError(e)
+				return
+			}
+
+			if e := dr.RmDnsSrv(p.ByName("type"), name); e != nil {
+				sink.pushError(e)
+			} else {
+				sink.pushEmpty()
+			}
+		})(w, r, p)
 	}))
 
-	router.DELETE(ds.root+"/services/instances/:name", CreateJsonAction(func(_ io.ReadCloser, sink *JsonSink, p httprouter.Params, q url.Values) {
+	router.DELETE(base+"/services/instances/:name", ds.securedName(CreateJsonAction(func(_ io.ReadCloser, sink *JsonSink, p httprouter.Params, q url.Values) {
 		server, err := getMandatoryQParam(q, "server")
 		if err != nil {
-			logger.Error(err.Error())
+			logger.Error("%s", err.Error())
 			sink.pushError(err)
 			return
 		}
 
 		sport, err := getMandatoryQParam(q, "port")
 		if err != nil {
-			logger.Error(err.Error())
+			logger.Error("%s", err.Error())
 			sink.pushError(err)
 			return
 		}
 
 		port, err := strconv.ParseUint(sport, 10, 32)
 		if err != nil {
-			logger.Error(err.Error())
+			logger.Error("%s", err.Error())
 			sink.pushError(err)
 			return
 		}
@@ -233,44 +649,57 @@ func (ds *DirectorServer) Run() {
 		} else {
 			sink.pushEmpty()
 		}
-	}))
+	})))
 
-	ds.s = &http.Server{
-		Addr:           ds.addr + ":" + strconv.FormatUint(uint64(ds.port), 10),
-		Handler:        router,
-		ReadTimeout:    60 * time.Second,
-		WriteTimeout:   60 * time.Second,
-		MaxHeaderBytes: 1 << 20,
-	}
-
-	logger.Info("Registring director's services in DNS ...")
-	if e := ds.regDnsServices(dr); e != nil {
-		logger.Error("Filed to registring service: %s", e.Error())
-		log.Fatal(e)
-	}
-	logger.Info("Director's services has been registered")
+	router.PATCH(base+"/services/instances/:name", ds.securedName(CreateDualJsonAction(func(src *json.Decoder, sink *JsonSink, p httprouter.Params, q url.Values) {
+		server, err := getMandatoryQParam(q, "server")
+		if err != nil {
+			logger.Error("%s", err.Error())
+			sink.pushError(err)
+			return
+		}
 
-	go func() {
-		logger.Info("Director server listening on http://%s%s", ds.s.Addr, ds.root)
-		if err := ds.s.ListenAndServe(); err != http.ErrServerClosed {
-			logger.Error("Director server listening and serve failed: %s", err.Error())
-			log.Fatal(err)
+		sport, err := getMandatoryQParam(q, "port")
+		if err != nil {
+			logger.Error("%s", err.Error())
+			sink.pushError(err)
+			return
 		}
-	}()
 
-	<-stop
+		port, err := strconv.ParseUint(sport, 10, 16)
+		if err != nil {
+			logger.Error("%s", err.Error())
+			sink.pushError(&ServerError{http.StatusBadRequest, ErrBadRequest, "Query parameter 'port' must be a number"})
+			return
+		}
 
-	logger.Info("Deleting director's instances of services in DNS ...")
-	if e := ds.delDnsServices(dr); e != nil {
-		logger.Error("Failed director's instances of services in DNS: %s", e.Error())
-	} else {
-		logger.Info("Director's instances of services has been deleted")
-	}
+		var patch director.DnsServicePatch
+		if e := src.Decode(&patch); e != nil {
+			logger.Error("Can't decode JSON to object: %s", e.Error())
+			sink.pushError(&ServerError{http.StatusBadRequest, ErrBadRequest, "bad JSON: " + e.Error()})
+			return
+		}
 
-	logger.Info("Shutting down Director server with %ds timeout ...", 10)
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	ds.s.Shutdown(ctx)
-	logger.Info("Directory server gracefully stopped")
+		if srv, e := dr.UpdateDnsSrv(p.ByName("name"), server, uint16(port), &patch); e != nil {
+			sink.pushError(e)
+		} else {
+			sink.push(srv)
+		}
+	})))
+
+	router.POST(base+"/services/reconcile", ds.secured(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		CreateJsonAction(func(_ io.ReadCloser, sink *JsonSink, p httprouter.Params, q url.Values) {
+			if e := ds.authorizeAll(r); e != nil {
+				sink.pushError(e)
+				return
+			}
+			if n, e := dr.Reconcile(); e != nil {
+				sink.pushError(e)
+			} else {
+				sink.push(map[string]int{"repaired": n})
+			}
+		})(w, r, p)
+	}))
 }
 
 func marshalError(code, msg string) []byte {
@@ -294,7 +723,15 @@ func returnError(w http.ResponseWriter, e error) {
 		} else {
 			w.WriteHeader(http.StatusBadRequest)
 		}*/
-		w.WriteHeader(http.StatusBadRequest)
+		if e.Code == director.ErrDirLeaseNotFound || e.Code == director.ErrDirInstNotFound {
+			w.WriteHeader(http.StatusNotFound)
+		} else if e.Code == director.ErrDirConflict {
+			w.WriteHeader(http.StatusConflict)
+		} else if e.Code == director.ErrDirWatchExpired {
+			w.WriteHeader(http.StatusGone)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
 		w.Write(e.Json())
 		return
 	default:
@@ -340,6 +777,11 @@ func (js *JsonSink) push(i interface{}) {
 	}
 }
 
+//Sets the header of the response, must be called before pushing.
+func (js *JsonSink) setHeader(key, value string) {
+	js.rw.Header().Set(key, value)
+}
+
 //Push an emptiness into JsonSink.
 func (js *JsonSink) pushEmpty() {
 	js.rw.WriteHeader(http.StatusNoContent)
@@ -349,6 +791,17 @@ func (js *JsonSink) pushCreated() {
 	js.rw.WriteHeader(http.StatusCreated)
 }
 
+//Push a created JSON object into JsonSink.
+func (js *JsonSink) pushCreatedObj(i interface{}) {
+	if j, e := json.Marshal(i); e != nil {
+		returnError(js.rw, e)
+	} else {
+		js.rw.Header().Set("Content-Type", "application/json")
+		js.rw.WriteHeader(http.StatusCreated)
+		js.rw.Write(j)
+	}
+}
+
 type httpRequest http.Request
 
 //Converts an HTTP request to the JsonSource if the request is valid and contains a valid JSON object in its body.
@@ -0,0 +1,149 @@
+package http
+
+import (
+	"encoding/json"
+	"git.reaxoft.loc/infomir/director/core"
+	"git.reaxoft.loc/infomir/director/dnsgate"
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDefaultSrvServicesAreRouted(t *testing.T) {
+	ds := &DirectorServer{root: "/director", domain: "cust.rxt"}
+	router := httprouter.New()
+	ds.route(router, ds.root, director.NewDirectorWithGate("cust.rxt", dnsgate.NewMemDnsGate()))
+	for _, si := range services {
+		// the path of a service is the prefix of the route, followed by a type or a name
+		path := "/director/services" + si.path + "/_bo._rest_http._tcp.cust.rxt"
+		if h, _, _ := router.Lookup(si.method, path); h == nil {
+			t.Errorf("%s: %s %s is not routed", si.name, si.method, path)
+		}
+	}
+}
+
+func TestSetSrvServices(t *testing.T) {
+	tests := []struct {
+		spec, err string
+		n         int
+	}{
+		{"reg_srv:PUT:,get_ins:get:/instances", "", 2},
+		{"reg_srv:PUT:,reg_srv:GET:/types", "given more than once", 0},
+		{"reg_srv:PUT", "not of 'name:METHOD:path' form", 0},
+		{"_reg:PUT:", "must be one label", 0},
+		{"reg_srv::", "has no method", 0},
+		{"get_ins:GET:instances", "must start with '/'", 0},
+	}
+	for _, tt := range tests {
+		ds := &DirectorServer{}
+		err := ds.SetSrvServices(tt.spec)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", tt.spec, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: error %v, want '%s'", tt.spec, err, tt.err)
+		case tt.err == "" && len(ds.srvinfos) != tt.n:
+			t.Errorf("%s: %d services, want %d", tt.spec, len(ds.srvinfos), tt.n)
+		}
+	}
+}
+
+func TestInstancesReportHealthState(t *testing.T) {
+	_, dr, h := newTestServer(nil)
+	defer dr.Shutdown()
+	const srvtype, name = "_bo._rest_http._tcp.cust.rxt.", "bo1._bo._rest_http._tcp.cust.rxt."
+	for _, srv := range []*director.DnsService{
+		{Name: name, Server: "h1.cust.rxt.", Port: 80, Params: map[string]string{director.CheckParam: director.CheckTcp, director.CheckIntervalParam: "3600"}},
+		{Name: name, Server: "h2.cust.rxt.", Port: 80},
+	} {
+		if _, err := dr.RegDnsSrv(srvtype, srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := serve(h, "GET", "/director/services/instances/"+name, "", "")
+	var srvs []*director.DnsService
+	if err := json.Unmarshal(w.Body.Bytes(), &srvs); err != nil {
+		t.Fatalf("%v: %s", err, w.Body.String())
+	}
+	states := make(map[string]string)
+	for _, srv := range srvs {
+		states[srv.Server] = srv.State
+	}
+	want := map[string]string{"h1.cust.rxt.": director.StatePassing, "h2.cust.rxt.": ""}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("states %v, want %v", states, want)
+	}
+	if strings.Count(w.Body.String(), `"state"`) != 1 {
+		t.Errorf("state of an unchecked instance is reported: %s", w.Body.String())
+	}
+}
+
+// A gate which runs race once after the next query, as a change made concurrently by another client.
+type racingGate struct {
+	dnsgate.DnsGate
+	race func()
+}
+
+func (g *racingGate) Query(typ uint16, key string) ([]dns.RR, error) {
+	rrs, err := g.DnsGate.Query(typ, key)
+	if race := g.race; race != nil {
+		g.race = nil
+		race()
+	}
+	return rrs, err
+}
+
+func TestPatchInstance(t *testing.T) {
+	const srvtype, name = "_bo._rest_http._tcp.cust.rxt.", "bo1._bo._rest_http._tcp.cust.rxt."
+	gate := &racingGate{DnsGate: dnsgate.NewMemDnsGate()}
+	ds := &DirectorServer{root: "/director", domain: "cust.rxt"}
+	dr := director.NewDirectorWithGate("cust.rxt", gate)
+	defer dr.Shutdown()
+	router := httprouter.New()
+	ds.route(router, ds.root, dr)
+	if _, err := dr.RegDnsSrv(srvtype, &director.DnsService{Name: name, Server: "h1.cust.rxt.", Port: 80}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, query, body string
+		race              bool
+		status            int
+	}{
+		{"port and params", "server=h1.cust.rxt&port=80", `{"port": 8080, "params": {"v": "2"}}`, false, http.StatusOK},
+		{"unknown instance", "server=h1.cust.rxt&port=80", `{"port": 8081}`, false, http.StatusNotFound},
+		{"concurrent change", "server=h1.cust.rxt&port=8080", `{"port": 8081}`, true, http.StatusConflict},
+		{"bad port", "server=h1.cust.rxt&port=http", `{"port": 8081}`, false, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if tt.race {
+			gate.race = func() {
+				dr.RegDnsSrv(srvtype, &director.DnsService{Name: name, Server: "h2.cust.rxt.", Port: 80})
+			}
+		}
+		w := serve(router, "PATCH", "/director/services/instances/"+name+"?"+tt.query, "", tt.body)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body.String())
+		}
+	}
+
+	srvs, err := dr.FindDnsSrvInstances(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched := 0
+	for _, srv := range srvs {
+		if srv.Server == "h1.cust.rxt." {
+			patched++
+			if srv.Port != 8080 || srv.Params["v"] != "2" {
+				t.Errorf("patched instance %+v, want port 8080 and v=2", srv)
+			}
+		}
+	}
+	if patched != 1 {
+		t.Errorf("%d instances at h1, want 1", patched)
+	}
+}
@@ -0,0 +1,106 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"git.reaxoft.loc/infomir/director/logger"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// Server certificate and client CA files, loaded again on reload.
+type tlsFiles struct {
+	cert, key, clientca string
+	// how client certificates are verified against clientca
+	clientauth tls.ClientAuthType
+	lock       sync.RWMutex
+	config     *tls.Config
+}
+
+// Loads the files, so a broken file does not replace the working configuration.
+func (tf *tlsFiles) load() error {
+	cert, err := tls.LoadX509KeyPair(tf.cert, tf.key)
+	if err != nil {
+		return err
+	}
+	// the config replaces the one of http.Server, which would offer HTTP/2 by itself
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12, NextProtos: []string{"h2", "http/1.1"}}
+	if tf.clientca != "" {
+		pem, err := ioutil.ReadFile(tf.clientca)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in '%s'", tf.clientca)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tf.clientauth
+	}
+	tf.lock.Lock()
+	tf.config = config
+	tf.lock.Unlock()
+	return nil
+}
+
+// Returns the TLS configuration handing out the last loaded files to each new connection.
+func (tf *tlsFiles) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			tf.lock.RLock()
+			defer tf.lock.RUnlock()
+			return tf.config, nil
+		},
+	}
+}
+
+// Returns the verified client certificate of the request, nil if there is none.
+func clientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// Prefix of the principals of client certificates, so a certificate can not pass for a token
+// or JWT principal of the same name.
+const CertPrincipalPrefix = "cert:"
+
+// The principal of a client certificate is "cert:" and its common name, or its first DNS name without one.
+func certPrincipal(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return CertPrincipalPrefix + cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return CertPrincipalPrefix + cert.DNSNames[0]
+	}
+	return ""
+}
+
+// Returns the host names of the client certificate: its DNS names and common name.
+func certNames(cert *x509.Certificate) []string {
+	names := append([]string(nil), cert.DNSNames...)
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+// Checks the TLS certificates can be loaded, so Run does not fail on them.
+func (ds *DirectorServer) CheckTls() error {
+	if ds.tlscert == "" {
+		return nil
+	}
+	return (&tlsFiles{cert: ds.tlscert, key: ds.tlskey, clientca: ds.tlsclientca}).load()
+}
+
+func reloadTls(tf *tlsFiles) {
+	if err := tf.load(); err != nil {
+		logger.Error("Failed to reload TLS certificates, the previous ones are kept: %s", err.Error())
+		return
+	}
+	logger.Info("TLS certificates have been reloaded")
+}
@@ -0,0 +1,159 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A certificate and its key issued by the test CA, or the CA itself.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// Issues a certificate of the common name signed by ca, self-signed CA if ca is nil.
+func issueCert(t *testing.T, ca *testCert, cn string, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		if usage == x509.ExtKeyUsageServerAuth {
+			tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key, der}
+}
+
+// Writes the certificate and its key as PEM files into dir.
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	kb, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestTlsFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := issueCert(t, nil, "Director CA", 0)
+	caPath, _ := ca.write(t, dir, "ca")
+	server := issueCert(t, ca, "director.cust.rxt", x509.ExtKeyUsageServerAuth)
+	certPath, keyPath := server.write(t, dir, "server")
+	client := issueCert(t, ca, "billing", x509.ExtKeyUsageClientAuth)
+
+	tf := &tlsFiles{cert: certPath, key: keyPath, clientca: caPath, clientauth: tls.VerifyClientCertIfGiven}
+	if err := tf.load(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &http.Server{TLSConfig: tf.tlsConfig(), Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cert := clientCert(r); cert != nil {
+			w.Write([]byte(certPrincipal(cert)))
+		}
+	})}
+	go s.ServeTLS(l, "", "")
+	defer s.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	// Returns the principal of the client certificate and the certificate served on a new connection
+	get := func(certs []tls.Certificate, protos []string) (string, *x509.Certificate, string) {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots, Certificates: certs, NextProtos: protos})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		state := conn.ConnectionState()
+		if state.NegotiatedProtocol == "h2" {
+			return "", state.PeerCertificates[0], state.NegotiatedProtocol
+		}
+		hc := &http.Client{Transport: &http.Transport{DialTLS: func(string, string) (net.Conn, error) { return conn, nil }}}
+		resp, err := hc.Get("https://" + l.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b), state.PeerCertificates[0], state.NegotiatedProtocol
+	}
+
+	if principal, served, _ := get([]tls.Certificate{client.tlsCert()}, nil); principal != "cert:billing" || served.Subject.CommonName != "director.cust.rxt" {
+		t.Errorf("principal '%s', served %s", principal, served.Subject.CommonName)
+	}
+	if principal, _, _ := get(nil, nil); principal != "" {
+		t.Errorf("principal without a client certificate '%s'", principal)
+	}
+	if _, _, proto := get(nil, []string{"h2", "http/1.1"}); proto != "h2" {
+		t.Errorf("negotiated '%s', want h2", proto)
+	}
+
+	// the replaced files are served on new connections once reloaded
+	renewed := issueCert(t, ca, "director2.cust.rxt", x509.ExtKeyUsageServerAuth)
+	renewed.write(t, dir, "server")
+	reloadTls(tf)
+	if _, served, _ := get(nil, nil); served.Subject.CommonName != "director2.cust.rxt" {
+		t.Errorf("served %s after the reload, want director2.cust.rxt", served.Subject.CommonName)
+	}
+
+	// a broken file does not replace the working configuration
+	ioutil.WriteFile(keyPath, []byte("broken"), 0600)
+	reloadTls(tf)
+	if _, served, _ := get(nil, nil); served.Subject.CommonName != "director2.cust.rxt" {
+		t.Errorf("served %s after a failed reload, want director2.cust.rxt", served.Subject.CommonName)
+	}
+}
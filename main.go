@@ -2,11 +2,14 @@ package main
 
 import (
 	"fmt"
+	"git.reaxoft.loc/infomir/director/dnsgate"
 	"git.reaxoft.loc/infomir/director/http"
 	"git.reaxoft.loc/infomir/director/logger"
 	"log"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 type OptsError struct {
@@ -17,6 +20,20 @@ func (e *OptsError) Error() string {
 	return fmt.Sprintf("Argument '%s': %s", e.arg, e.msg)
 }
 
+// Tells whether errs have an OptsError of any of the args.
+func hasOptsError(errs []error, args ...string) bool {
+	for _, err := range errs {
+		if oe, ok := err.(*OptsError); ok {
+			for _, arg := range args {
+				if oe.arg == arg {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
 func dummyDefHandler() error { return nil }
 func mandatoryDefHandler(arg string) func() error {
 	return func() error {
@@ -24,31 +41,74 @@ func mandatoryDefHandler(arg string) func() error {
 	}
 }
 
+const usage = `Usage: director [options]
+
+Options (-a, -p, -h, -r and -d are also accepted as --addr, --port, --hostname, --root and --domain):
+  --config - YAML file with options by their long names without dashes, e.g. "dns-s: 172.25.0.160:53".
+  --help - print this help.
+  -a - address on which to run server. Default value is ""
+  -p - port on which to run server. Default value is 8080.
+  -h - hostname of services. Default value is machine hostname.
+  -r - path root to use. Default value is "/director".
+  -d - base domain of all services. Default value is "changeme".
+  --drt-dns-ttl - ttl of DNS records for directory services.
+  --drt-dns-p - priority of DNS SRV record for directory services.
+  --drt-dns-w - weight of DNS SRV record for directory services.
+  --drt-type - type of directory services without the domain, replicas of director register their instances under it. Default value is "_drt._rest_http".
+  --drt-services - comma separated directory services as "name:METHOD:path", the path is relative to "<root>/services".
+    Default value is "reg_srv:PUT:,get_srvs:GET:/types,get_ins:GET:/instances,del_srv:DELETE:/types,del_ins:DELETE:/instances".
+  --dns-backend - where DNS records are kept. Possible values: remote (DNS server given by --dns-s), memory (no DNS server, records are lost on exit),
+    embedded (director itself is the authoritative DNS server of the -d domain). Default value is "remote".
+  --dns-listen - address of the embedded DNS server. Default value is ":53".
+  --dns-s - DNS server address. Mandatory for the remote backend.
+  --dns-net - transport to reach DNS server. Possible values: udp, tcp, tls. Default value is "udp".
+  --dns-tls-ca - CA bundle to verify DNS server certificate with when --dns-net is tls. By default the system roots are used.
+  --dns-udp-size - EDNS0 UDP buffer size advertised in DNS queries. Default value is 4096.
+  --dns-pk - private key to sign command for DNS (RFC2931). Default value is "./dns.private", the embedded backend
+    runs without a key if the default one is missing.
+  --dns-tsig - BIND key file with a TSIG secret (hmac-sha256 or hmac-sha512) to sign commands for DNS (RFC2845) instead of --dns-pk.
+  --store - file to keep registrations in. They are pushed to DNS again on startup if DNS lost them. By default registrations are not kept.
+  --lease-ttl - lease duration in seconds for registrations which do not request one. Default value is 0, such registrations never expire.
+  --namespaces - JSON file of namespaces, each one is a zone with its own DNS server and key served under "<root>/<namespace>",
+    e.g. {"stage": {"domain": "stage.cust.rxt", "dns_s": "172.25.0.161:53", "dns_tsig": "stage.tsig"}}. The -d domain is served under the root.
+  --trusted-proxies - comma separated networks (CIDR) or addresses of proxies whose X-Forwarded-For header is honored
+    when the client address is used as the server of a registration without one. By default no proxy is trusted.
+  --auth - JSON file with static bearer tokens, HMAC keys and a JWKS file to authenticate PUT, POST, PATCH and DELETE requests,
+    and the rules on which service types and name prefixes each principal may change. By default requests are not authenticated.
+  --tls-cert - certificate file (PEM) to serve HTTPS with, --tls-key is required with it. Both are loaded again on SIGHUP. By default plain HTTP is served.
+  --tls-key - private key file (PEM) of --tls-cert.
+  --tls-client-ca - CA bundle (PEM) to verify client certificates with. Without --auth every client must present a certificate
+    and may change only the instances on the hosts named in it. With --auth "cert:<common name>" of a certificate is one more principal,
+    and rules may restrict its servers to "$self", the names of the certificate.
+  --log-file - log file path for a log output. By default the log output is stdout.
+  --log-level - logging level. Possible values: panic, fatal, error, warn, info, debug. By default "info".
+
+Every option may be set by an environment variable as well, e.g. DIRECTOR_DNS_S for --dns-s.
+The command line overrides environment variables, and they override the config file.
+`
+
 type OptsDesc struct {
 	prmsCnt    int
 	handler    func(p []string) error
 	defhandler func() error
 }
 
-//Main function runs Director server. The following options are avaliable:
-// -a - address on which to run server. Default value is ""
-// -p - port on which to run server. Default value is 8080.
-// -h - hostname of services. Default value is machine hostname.
-// -r - path root to use. Default value is "/director".
-// -d - base domain of all services. Default value is "changeme".
-// --drt-dns-ttl - ttl of DNS records for directory services.
-// --drt-dns-p - priority of DNS SRV record for directory services.
-// --drt-dns-w - weight of DNS SRV record for directory services.
-// --dns-s - DNS server address. Default value is "changeme".
-// --dns-pk - private key to sign command for DNS (RFC2931). Default value is "./dns.private".
-// --log-file - log file path for a log output. By default the log output is stdout.
-// --log-level - logging level. Possible values: panic, fatal, error, warn, info, debug. By default "info".
+//Main function runs Director server. The options are listed in usage and printed by --help.
+//Every option may be given on the command line, in the YAML file of --config (or DIRECTOR_CONFIG) by its long name
+//without dashes, e.g. "dns-s: 172.25.0.160:53" or "domain: cust.rxt" for -d, or by an environment variable, e.g.
+//DIRECTOR_DNS_S or DIRECTOR_DOMAIN. The command line overrides the environment, which overrides the config file.
 //Run example: ./director -a 172.25.0.144 -h szaytsev.cust.rxt -d cust.rxt --dns-s 172.25.0.160:53 --dns-pk /Users/szaytsev/Kszaytsev.cust.rxt.+008+33265.private --log-level debug
 //
 //Emaple of DNS configuration: https://0x2c.org/rfc2136-ddns-bind-dnssec-for-home-router-dynamic-dns/
 //Example of the command to generate dns-pk: dnssec-keygen -C -r /dev/urandom -a RSASHA256 -b 2048 -n HOST -T KEY ivanov.cust.rxt
+//ECDSAP256SHA256, ECDSAP384SHA384 and ED25519 keys are supported as well: dnssec-keygen -a ED25519 -n HOST -T KEY ivanov.cust.rxt
+//Example of the command to generate dns-tsig: tsig-keygen -a hmac-sha256 ivanov.cust.rxt > ivanov.cust.rxt.tsig
 func main() {
-	var srv = http.NewServer("", 8080, "", "/director", "", "", "./dns.private")
+	var srv = http.NewServer("", 8080, "", "/director", "", "", http.DefaultDnsPk)
+	var dnsBackend = http.DnsBackendRemote
+	var dnsListen = ":53"
+	var tlsCert, tlsKey, tlsClientCa string
+	var namespacesPath string
 	var logfile *os.File
 	defer func() {
 		if logfile != nil {
@@ -87,14 +147,159 @@ func main() {
 			srv.SetDomain(p[0])
 			return nil
 		}, mandatoryDefHandler("-d")},
+		"--drt-dns-ttl": {1, func(p []string) error {
+			ttl, err := strconv.ParseUint(p[0], 10, 32)
+			if err != nil {
+				return err
+			}
+			srv.SetSrvTtl(uint32(ttl))
+			return nil
+		}, dummyDefHandler},
+		"--drt-dns-p": {1, func(p []string) error {
+			priority, err := strconv.ParseUint(p[0], 10, 16)
+			if err != nil {
+				return err
+			}
+			srv.SetSrvPriority(uint16(priority))
+			return nil
+		}, dummyDefHandler},
+		"--drt-dns-w": {1, func(p []string) error {
+			weight, err := strconv.ParseUint(p[0], 10, 16)
+			if err != nil {
+				return err
+			}
+			srv.SetSrvWeight(uint16(weight))
+			return nil
+		}, dummyDefHandler},
+		"--drt-type": {1, func(p []string) error {
+			for _, label := range strings.Split(strings.Trim(p[0], "."), ".") {
+				if !strings.HasPrefix(label, "_") {
+					return &OptsError{"--drt-type", "every part must start with '_'"}
+				}
+			}
+			srv.SetSrvTypePrefix(p[0])
+			return nil
+		}, dummyDefHandler},
+		"--drt-services": {1, func(p []string) error {
+			if err := srv.SetSrvServices(p[0]); err != nil {
+				return &OptsError{"--drt-services", err.Error()}
+			}
+			return nil
+		}, dummyDefHandler},
+		"--dns-backend": {1, func(p []string) error {
+			switch p[0] {
+			case http.DnsBackendRemote, http.DnsBackendMemory, http.DnsBackendEmbedded:
+				dnsBackend = p[0]
+				srv.SetDnsBackend(p[0])
+				return nil
+			default:
+				return &OptsError{"--dns-backend", "must be one of remote, memory, embedded"}
+			}
+		}, dummyDefHandler},
+		"--dns-listen": {1, func(p []string) error {
+			dnsListen = p[0]
+			srv.SetDnsListen(p[0])
+			return nil
+		}, dummyDefHandler},
 		"--dns-s": {1, func(p []string) error {
 			srv.SetDnsServer(p[0])
 			return nil
-		}, mandatoryDefHandler("-dns-s")},
+		}, func() error {
+			if dnsBackend == http.DnsBackendRemote {
+				return mandatoryDefHandler("--dns-s")()
+			}
+			return nil
+		}},
+		"--dns-net": {1, func(p []string) error {
+			switch p[0] {
+			case dnsgate.NetUdp, dnsgate.NetTcp, dnsgate.NetTls:
+				srv.SetDnsNet(p[0])
+				return nil
+			default:
+				return &OptsError{"--dns-net", "must be one of udp, tcp, tls"}
+			}
+		}, dummyDefHandler},
+		"--dns-tls-ca": {1, func(p []string) error {
+			srv.SetDnsTlsCa(p[0])
+			return nil
+		}, dummyDefHandler},
+		"--dns-udp-size": {1, func(p []string) error {
+			size, err := strconv.ParseUint(p[0], 10, 16)
+			if err != nil {
+				return err
+			}
+			if size < 512 {
+				return &OptsError{"--dns-udp-size", "must not be less than 512"}
+			}
+			srv.SetDnsUdpSize(uint16(size))
+			return nil
+		}, dummyDefHandler},
 		"--dns-pk": {1, func(p []string) error {
 			srv.SetDnsPk(p[0])
 			return nil
 		}, dummyDefHandler},
+		"--dns-tsig": {1, func(p []string) error {
+			srv.SetDnsTsig(p[0])
+			return nil
+		}, dummyDefHandler},
+		"--store": {1, func(p []string) error {
+			srv.SetStore(p[0])
+			return nil
+		}, dummyDefHandler},
+		"--lease-ttl": {1, func(p []string) error {
+			ttl, err := strconv.ParseUint(p[0], 10, 32)
+			if err != nil {
+				return err
+			}
+			srv.SetLeaseTtl(uint32(ttl))
+			return nil
+		}, dummyDefHandler},
+		"--namespaces": {1, func(p []string) error {
+			// loaded once all options are applied, see below
+			namespacesPath = p[0]
+			return nil
+		}, dummyDefHandler},
+		"--trusted-proxies": {1, func(p []string) error {
+			nets, err := http.ParseNets(p[0])
+			if err != nil {
+				return &OptsError{"--trusted-proxies", err.Error()}
+			}
+			srv.SetTrustedProxies(nets)
+			return nil
+		}, dummyDefHandler},
+		"--auth": {1, func(p []string) error {
+			a, err := http.LoadAuth(p[0])
+			if err != nil {
+				return &OptsError{"--auth", err.Error()}
+			}
+			srv.SetAuth(a)
+			return nil
+		}, dummyDefHandler},
+		"--tls-cert": {1, func(p []string) error {
+			tlsCert = p[0]
+			srv.SetTls(tlsCert, tlsKey)
+			return nil
+		}, func() error {
+			if tlsKey != "" || tlsClientCa != "" {
+				return mandatoryDefHandler("--tls-cert")()
+			}
+			return nil
+		}},
+		"--tls-key": {1, func(p []string) error {
+			tlsKey = p[0]
+			srv.SetTls(tlsCert, tlsKey)
+			return nil
+		}, func() error {
+			if tlsCert != "" {
+				return mandatoryDefHandler("--tls-key")()
+			}
+			return nil
+		}},
+		"--tls-client-ca": {1, func(p []string) error {
+			tlsClientCa = p[0]
+			srv.SetTlsClientCa(p[0])
+			return nil
+		}, dummyDefHandler},
 		"--log-file": {1, func(p []string) error {
 			var err error
 			if logfile, err = os.OpenFile(p[0], os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
@@ -109,26 +314,84 @@ func main() {
 		}, dummyDefHandler},
 	}
 
+	// options of the command line are taken aside to apply them over the environment and the config
+	var errs []error
+	cli := make(map[string][]string)
+	configPath := os.Getenv(envPrefix + "CONFIG")
 	args := os.Args[1:]
 	for len(args) > 0 {
-		if v, e := opts[args[0]]; e && len(args)-1 >= v.prmsCnt {
-			if err := v.handler(args[1 : v.prmsCnt+1]); err != nil {
-				log.Fatalln(err)
-				os.Exit(127)
-			}
-			delete(opts, args[0])
-			args = args[1+v.prmsCnt:]
+		if args[0] == "--help" {
+			fmt.Print(usage)
+			return
+		}
+		if args[0] == "--config" && len(args) > 1 {
+			configPath = args[1]
+			args = args[2:]
+			continue
+		}
+		if opt, e := optName(args[0], opts); e && len(args)-1 >= opts[opt].prmsCnt {
+			cli[opt] = args[1 : opts[opt].prmsCnt+1]
+			args = args[1+opts[opt].prmsCnt:]
 		} else {
-			log.Fatalf("Wrong argument '%s'", args[0])
-			os.Exit(127)
+			errs = append(errs, fmt.Errorf("Wrong argument '%s'", args[0]))
+			args = args[1:]
+		}
+	}
+
+	var config map[string][]string
+	if configPath != "" {
+		var cerrs []error
+		config, cerrs = loadConfig(configPath, opts)
+		errs = append(errs, cerrs...)
+	}
+	values := mergeValues(config, envValues(opts), cli)
+
+	names := make([]string, 0, len(values))
+	for opt := range values {
+		names = append(names, opt)
+	}
+	sort.Strings(names)
+	for _, opt := range names {
+		if err := opts[opt].handler(values[opt]); err != nil {
+			if _, ok := err.(*OptsError); !ok {
+				err = &OptsError{opt, err.Error()}
+			}
+			errs = append(errs, err)
 		}
+		delete(opts, opt)
 	}
 
 	for _, v := range opts {
 		if err := v.defhandler(); err != nil {
-			log.Fatalln(err)
-			os.Exit(127)
+			errs = append(errs, err)
+		}
+	}
+	// the namespaces of the embedded backend listen where --dns-listen tells, so they are loaded
+	// after all options, not in the order of the option names
+	if namespacesPath != "" {
+		var listen string
+		if dnsBackend == http.DnsBackendEmbedded {
+			listen = dnsListen
+		}
+		if nss, err := http.LoadNamespaces(namespacesPath, listen); err != nil {
+			errs = append(errs, &OptsError{"--namespaces", err.Error()})
+		} else {
+			srv.SetNamespaces(nss)
+		}
+	}
+	// a missing or half given pair is already reported
+	if !hasOptsError(errs, "--tls-cert", "--tls-key") {
+		if err := srv.CheckTls(); err != nil {
+			errs = append(errs, &OptsError{"--tls-cert", err.Error()})
+		}
+	}
+
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Println(err)
 		}
+		log.Printf("%d errors in options, see --help", len(errs))
+		os.Exit(127)
 	}
 
 	logger.Info("Starting director server...")
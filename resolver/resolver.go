@@ -0,0 +1,225 @@
+// Package resolver picks instances of a service by their SRV priority and weight as described in RFC 2782.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"git.reaxoft.loc/infomir/director/client"
+	"git.reaxoft.loc/infomir/director/core"
+	"github.com/miekg/dns"
+	"math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrNoInstances = errors.New("resolver: service has no available instances")
+
+// A source of service instances.
+type Source interface {
+	Lookup(ctx context.Context, srvname string) ([]*director.DnsService, error)
+}
+
+type directorSource struct {
+	c *client.Client
+}
+
+// Looks instances up through the director HTTP API.
+func DirectorSource(c *client.Client) Source {
+	return &directorSource{c: c}
+}
+
+func (s *directorSource) Lookup(ctx context.Context, srvname string) ([]*director.DnsService, error) {
+	return s.c.FindInstances(ctx, srvname)
+}
+
+type dnsSource struct {
+	server string
+}
+
+// Looks SRV records up directly in DNS at server, e.g. "10.0.0.1:53". Params of the instances are not filled.
+func DnsSource(server string) Source {
+	return &dnsSource{server: server}
+}
+
+func (s *dnsSource) Lookup(ctx context.Context, srvname string) ([]*director.DnsService, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(srvname), dns.TypeSRV)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	r, _, e := (&dns.Client{Net: "udp"}).ExchangeContext(ctx, m, s.server)
+	if e == nil && r.Truncated {
+		r, _, e = (&dns.Client{Net: "tcp"}).ExchangeContext(ctx, m, s.server)
+	}
+	if e != nil {
+		return nil, e
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, errors.New("resolver: DNS query of '" + srvname + "' failed: " + dns.RcodeToString[r.Rcode])
+	}
+	var srvs []*director.DnsService
+	for _, rr := range r.Answer {
+		if t, ok := rr.(*dns.SRV); ok {
+			srvs = append(srvs, &director.DnsService{Name: t.Hdr.Name, Server: t.Target, Port: t.Port,
+				Ttl: t.Hdr.Ttl, Priority: t.Priority, Weight: t.Weight})
+		}
+	}
+	return srvs, nil
+}
+
+type entry struct {
+	srvs    []*director.DnsService
+	expires time.Time
+}
+
+// Resolves service names to ordered instances. Instances are cached for the shortest TTL
+// among them, instances with zero TTL are not cached.
+type Resolver struct {
+	src   Source
+	lock  sync.Mutex
+	cache map[string]*entry
+	rnd   *rand.Rand
+}
+
+func New(src Source) *Resolver {
+	return &Resolver{src: src, cache: make(map[string]*entry), rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (r *Resolver) lookup(ctx context.Context, srvname string) ([]*director.DnsService, error) {
+	key := dns.CanonicalName(srvname)
+	r.lock.Lock()
+	if e, ok := r.cache[key]; ok && time.Now().Before(e.expires) {
+		r.lock.Unlock()
+		return e.srvs, nil
+	}
+	r.lock.Unlock()
+
+	found, err := r.src.Lookup(ctx, srvname)
+	if err != nil {
+		return nil, err
+	}
+	var srvs []*director.DnsService
+	var ttl uint32
+	for _, srv := range found {
+		// the target "." means the service is decidedly not available, a critical instance
+		// failed its health checks and is withdrawn from DNS
+		if srv.Server == "." || srv.State == director.StateCritical {
+			continue
+		}
+		if len(srvs) == 0 || srv.Ttl < ttl {
+			ttl = srv.Ttl
+		}
+		srvs = append(srvs, srv)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if ttl > 0 {
+		r.cache[key] = &entry{srvs: srvs, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+	} else {
+		delete(r.cache, key)
+	}
+	return srvs, nil
+}
+
+// Returns the instances in the order to contact them: by ascending priority, and within
+// a priority in weighted random order.
+func (r *Resolver) Order(ctx context.Context, srvname string) ([]*director.DnsService, error) {
+	srvs, err := r.lookup(ctx, srvname)
+	if err != nil {
+		return nil, err
+	}
+	if len(srvs) == 0 {
+		return nil, ErrNoInstances
+	}
+
+	sorted := append([]*director.DnsService(nil), srvs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority < sorted[j].Priority })
+	ordered := make([]*director.DnsService, 0, len(sorted))
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for start := 0; start < len(sorted); {
+		end := start
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			end++
+		}
+		ordered = append(ordered, r.weighted(sorted[start:end])...)
+		start = end
+	}
+	return ordered, nil
+}
+
+// Orders instances of the same priority by the RFC 2782 selection. Must be called with the lock held.
+func (r *Resolver) weighted(group []*director.DnsService) []*director.DnsService {
+	left := make([]*director.DnsService, 0, len(group))
+	// zero weight instances are placed first, so they have a small chance to be selected
+	for _, srv := range group {
+		if srv.Weight == 0 {
+			left = append(left, srv)
+		}
+	}
+	for _, srv := range group {
+		if srv.Weight != 0 {
+			left = append(left, srv)
+		}
+	}
+
+	ordered := make([]*director.DnsService, 0, len(group))
+	for len(left) > 0 {
+		var sum int
+		for _, srv := range left {
+			sum += int(srv.Weight)
+		}
+		n := r.rnd.Intn(sum + 1)
+		i, running := 0, 0
+		for ; i < len(left)-1; i++ {
+			if running += int(left[i].Weight); running >= n {
+				break
+			}
+		}
+		ordered = append(ordered, left[i])
+		left = append(left[:i], left[i+1:]...)
+	}
+	return ordered
+}
+
+// Returns the instance to contact.
+func (r *Resolver) Pick(ctx context.Context, srvname string) (*director.DnsService, error) {
+	srvs, err := r.Order(ctx, srvname)
+	if err != nil {
+		return nil, err
+	}
+	return srvs[0], nil
+}
+
+// Calls fn with instances in the order to contact them until fn succeeds or fails with
+// an error other than a connection error. Returns the last error of fn.
+func (r *Resolver) Do(ctx context.Context, srvname string, fn func(*director.DnsService) error) error {
+	srvs, err := r.Order(ctx, srvname)
+	if err != nil {
+		return err
+	}
+	for _, srv := range srvs {
+		if err = fn(srv); err == nil || !IsConnError(err) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// Reports whether the error is a failure to connect to the instance or a timeout, so
+// the next instance may be tried.
+func IsConnError(e error) bool {
+	if ue, ok := e.(*url.Error); ok {
+		e = ue.Err
+	}
+	if ne, ok := e.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	_, ok := e.(*net.OpError)
+	return ok
+}
@@ -0,0 +1,167 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"git.reaxoft.loc/infomir/director/core"
+	"math"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// Counts lookups of the instances it is made of.
+type fakeSource struct {
+	srvs    []*director.DnsService
+	lookups int
+}
+
+func (s *fakeSource) Lookup(ctx context.Context, srvname string) ([]*director.DnsService, error) {
+	s.lookups++
+	return s.srvs, nil
+}
+
+func TestLookupCachesForShortestTtl(t *testing.T) {
+	tests := []struct {
+		name    string
+		srvs    []*director.DnsService
+		lookups int
+	}{
+		{"one instance", []*director.DnsService{{Server: "h1.cust.rxt.", Ttl: 60}}, 1},
+		{"zero TTL", []*director.DnsService{{Server: "h1.cust.rxt.", Ttl: 60}, {Server: "h2.cust.rxt.", Ttl: 0}}, 2},
+		{"unavailable first", []*director.DnsService{{Server: ".", Ttl: 0}, {Server: "h1.cust.rxt.", Ttl: 60}}, 1},
+	}
+	for _, tt := range tests {
+		src := &fakeSource{srvs: tt.srvs}
+		r := New(src)
+		for i := 0; i < 2; i++ {
+			if _, err := r.lookup(context.Background(), "bo1._bo._rest_http._tcp.cust.rxt."); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		if src.lookups != tt.lookups {
+			t.Errorf("%s: %d lookups, want %d", tt.name, src.lookups, tt.lookups)
+		}
+	}
+}
+
+func TestOrderByPriorityAndWeight(t *testing.T) {
+	tests := []struct {
+		name string
+		srvs []*director.DnsService
+		// the share of orders starting with each server, within 0.03
+		first map[string]float64
+	}{
+		{"priority first", []*director.DnsService{
+			{Server: "h1.cust.rxt.", Priority: 20, Weight: 100, Ttl: 60},
+			{Server: "h2.cust.rxt.", Priority: 10, Weight: 1, Ttl: 60},
+		}, map[string]float64{"h2.cust.rxt.": 1}},
+		// the random number of 0..4 selects the first instance whose running sum reaches it
+		{"by weight", []*director.DnsService{
+			{Server: "h1.cust.rxt.", Priority: 10, Weight: 1, Ttl: 60},
+			{Server: "h2.cust.rxt.", Priority: 10, Weight: 3, Ttl: 60},
+		}, map[string]float64{"h1.cust.rxt.": 0.4, "h2.cust.rxt.": 0.6}},
+		{"zero weight has a small chance", []*director.DnsService{
+			{Server: "h1.cust.rxt.", Priority: 10, Weight: 9, Ttl: 60},
+			{Server: "h2.cust.rxt.", Priority: 10, Weight: 0, Ttl: 60},
+		}, map[string]float64{"h1.cust.rxt.": 0.9, "h2.cust.rxt.": 0.1}},
+		{"unavailable instance is left out", []*director.DnsService{
+			{Server: ".", Priority: 0, Weight: 0, Ttl: 60},
+			{Server: "h1.cust.rxt.", Priority: 10, Weight: 0, Ttl: 60},
+		}, map[string]float64{"h1.cust.rxt.": 1}},
+	}
+	const n = 10000
+	for _, tt := range tests {
+		r := New(&fakeSource{srvs: tt.srvs})
+		r.rnd = rand.New(rand.NewSource(1))
+		firsts := make(map[string]int)
+		for i := 0; i < n; i++ {
+			srvs, err := r.Order(context.Background(), "bo1._bo._rest_http._tcp.cust.rxt.")
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			firsts[srvs[0].Server]++
+			for j := 1; j < len(srvs); j++ {
+				if srvs[j].Priority < srvs[j-1].Priority {
+					t.Fatalf("%s: %s of priority %d follows priority %d", tt.name, srvs[j].Server, srvs[j].Priority, srvs[j-1].Priority)
+				}
+			}
+		}
+		for server, share := range tt.first {
+			if got := float64(firsts[server]) / n; math.Abs(got-share) > 0.03 {
+				t.Errorf("%s: %s is first in %.3f of orders, want %.3f", tt.name, server, got, share)
+			}
+		}
+	}
+}
+
+func TestNoAvailableInstances(t *testing.T) {
+	tests := []struct {
+		name string
+		srvs []*director.DnsService
+	}{
+		{"none", nil},
+		{"unavailable only", []*director.DnsService{{Server: ".", Ttl: 60}}},
+	}
+	for _, tt := range tests {
+		if _, err := New(&fakeSource{srvs: tt.srvs}).Pick(context.Background(), "bo1._bo._rest_http._tcp.cust.rxt."); err != ErrNoInstances {
+			t.Errorf("%s: %v, want %v", tt.name, err, ErrNoInstances)
+		}
+	}
+}
+
+func TestDoTriesNextOnConnError(t *testing.T) {
+	connErr := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	otherErr := errors.New("bad request")
+	tests := []struct {
+		name  string
+		errs  map[string]error
+		tried int
+		err   error
+	}{
+		{"first succeeds", map[string]error{}, 1, nil},
+		{"next after a connection error", map[string]error{"h1.cust.rxt.": connErr}, 2, nil},
+		{"stop on another error", map[string]error{"h1.cust.rxt.": otherErr}, 1, otherErr},
+		{"all fail to connect", map[string]error{"h1.cust.rxt.": connErr, "h2.cust.rxt.": connErr}, 2, connErr},
+	}
+	for _, tt := range tests {
+		r := New(&fakeSource{srvs: []*director.DnsService{
+			{Server: "h1.cust.rxt.", Priority: 10, Ttl: 60},
+			{Server: "h2.cust.rxt.", Priority: 20, Ttl: 60},
+		}})
+		var tried int
+		err := r.Do(context.Background(), "bo1._bo._rest_http._tcp.cust.rxt.", func(srv *director.DnsService) error {
+			tried++
+			return tt.errs[srv.Server]
+		})
+		if err != tt.err || tried != tt.tried {
+			t.Errorf("%s: %v after %d tries, want %v after %d", tt.name, err, tried, tt.err, tt.tried)
+		}
+	}
+}
+
+func TestCriticalInstanceIsNeverPicked(t *testing.T) {
+	r := New(&fakeSource{srvs: []*director.DnsService{
+		{Server: "h1.cust.rxt.", Priority: 0, Weight: 100, Ttl: 60, State: director.StateCritical},
+		{Server: "h2.cust.rxt.", Priority: 10, Weight: 0, Ttl: 60, State: director.StatePassing},
+		{Server: "h3.cust.rxt.", Priority: 10, Weight: 0, Ttl: 60, State: director.StateFailing},
+	}})
+	for i := 0; i < 100; i++ {
+		srvs, err := r.Order(context.Background(), "bo1._bo._rest_http._tcp.cust.rxt.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(srvs) != 2 {
+			t.Fatalf("%d instances ordered, want 2", len(srvs))
+		}
+		for _, srv := range srvs {
+			if srv.State == director.StateCritical {
+				t.Fatalf("critical %s is ordered", srv.Server)
+			}
+		}
+	}
+	r = New(&fakeSource{srvs: []*director.DnsService{{Server: "h1.cust.rxt.", Ttl: 60, State: director.StateCritical}}})
+	if _, err := r.Pick(context.Background(), "bo1._bo._rest_http._tcp.cust.rxt."); err != ErrNoInstances {
+		t.Errorf("%v, want %v", err, ErrNoInstances)
+	}
+}